@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"time"
+)
+
+var confirmCmd = &cobra.Command{
+	Use:          "confirm INTERFACE",
+	Short:        "Confirm the change applied with --confirm-timeout, so it is not rolled back",
+	Args:         cobra.ExactArgs(1),
+	RunE:         Confirm,
+	SilenceUsage: true,
+}
+
+var watchdogCmd = &cobra.Command{
+	Use:          "watchdog INTERFACE DEADLINE",
+	Hidden:       true,
+	Args:         cobra.ExactArgs(2),
+	RunE:         Watchdog,
+	SilenceUsage: true,
+}
+
+const confirmStateDir = "/run/wg-apply/confirm"
+
+// pendingConfirm is a change waiting for "wg-apply confirm", which is rolled
+// back to Snapshot by the watchdog with PID after Deadline.
+type pendingConfirm struct {
+	Deadline time.Time `json:"deadline"`
+	PID      int       `json:"pid"`
+	Snapshot *snapshot `json:"snapshot"`
+}
+
+func pendingConfirmPath(ifce string) string {
+	return filepath.Join(confirmStateDir, ifce+".json")
+}
+
+// readPendingConfirm returns nil if no change of ifce is waiting for
+// confirmation.
+func readPendingConfirm(ifce string) (pending *pendingConfirm, err error) {
+	statePath := pendingConfirmPath(ifce)
+	b, err := os.ReadFile(statePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+			return
+		}
+		err = fmt.Errorf("failed to read confirm state %s: %w", statePath, err)
+		return
+	}
+	pending = &pendingConfirm{}
+	err = json.Unmarshal(b, pending)
+	if err != nil {
+		err = fmt.Errorf("failed to parse confirm state %s: %w", statePath, err)
+		return
+	}
+	return
+}
+
+// startConfirmWatchdog forks a watchdog which rolls back to snap after the
+// timeout, unless confirmed. The state contains the private key, so it is
+// only readable by root.
+func startConfirmWatchdog(snap *snapshot, timeout time.Duration) (err error) {
+	err = os.MkdirAll(confirmStateDir, 0700)
+	if err != nil {
+		err = fmt.Errorf("failed to create dir %s: %w", confirmStateDir, err)
+		return
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		err = fmt.Errorf("failed to find the executable of wg-apply: %w", err)
+		return
+	}
+	logPath := filepath.Join(confirmStateDir, snap.Interface+".log")
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		err = fmt.Errorf("failed to open watchdog log %s: %w", logPath, err)
+		return
+	}
+	defer logFile.Close()
+
+	// the state is written before the watchdog starts, so the watchdog never
+	// takes a missing state for a confirmation
+	pending := &pendingConfirm{
+		Deadline: time.Now().Add(timeout),
+		Snapshot: snap,
+	}
+	err = writePendingConfirm(snap.Interface, pending)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(pendingConfirmPath(snap.Interface))
+		}
+	}()
+
+	cmd := exec.Command(exe, "watchdog", snap.Interface, pending.Deadline.Format(time.RFC3339Nano))
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = &unix.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	if err != nil {
+		err = fmt.Errorf("failed to start watchdog: %w", err)
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = cmd.Process.Kill()
+		}
+		_ = cmd.Process.Release()
+	}()
+
+	// the pid lets "wg-apply confirm" stop the watchdog right away
+	pending.PID = cmd.Process.Pid
+	err = writePendingConfirm(snap.Interface, pending)
+	if err != nil {
+		return
+	}
+	log.Printf("the change of %s is rolled back in %s, unless \"wg-apply confirm %s\" is run", snap.Interface, timeout, snap.Interface)
+	return
+}
+
+func writePendingConfirm(ifce string, pending *pendingConfirm) (err error) {
+	b, err := json.Marshal(pending)
+	if err != nil {
+		return
+	}
+	// renamed into place, so the watchdog never reads a partial state
+	statePath := pendingConfirmPath(ifce)
+	err = os.WriteFile(statePath+".tmp", b, 0600)
+	if err == nil {
+		err = os.Rename(statePath+".tmp", statePath)
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to write confirm state %s: %w", statePath, err)
+		return
+	}
+	return
+}
+
+func Confirm(cmd *cobra.Command, args []string) (err error) {
+	ifce := args[0]
+	pending, err := readPendingConfirm(ifce)
+	if err != nil {
+		return
+	}
+	if pending == nil {
+		err = fmt.Errorf("no change of %s is waiting for confirmation", ifce)
+		return
+	}
+	err = cancelPendingConfirm(ifce, pending)
+	if err != nil {
+		return
+	}
+	log.Printf("the change of %s is confirmed", ifce)
+	return
+}
+
+// cancelPendingConfirm stops the watchdog of pending, so the change is kept.
+func cancelPendingConfirm(ifce string, pending *pendingConfirm) (err error) {
+	err = os.Remove(pendingConfirmPath(ifce))
+	if err != nil {
+		err = fmt.Errorf("failed to remove confirm state: %w", err)
+		return
+	}
+	if pending.PID > 0 {
+		// the watchdog also gives up once the state is removed
+		_ = unix.Kill(pending.PID, unix.SIGTERM)
+	}
+	return
+}
+
+func Watchdog(cmd *cobra.Command, args []string) (err error) {
+	ifce := args[0]
+	deadline, err := time.Parse(time.RFC3339Nano, args[1])
+	if err != nil {
+		err = fmt.Errorf("invalid deadline %s: %w", args[1], err)
+		return
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, unix.SIGTERM)
+	defer cancel()
+	pending, err := readPendingConfirm(ifce)
+	if err != nil {
+		return
+	}
+	if pending == nil {
+		err = fmt.Errorf("no change of %s is waiting for confirmation", ifce)
+		return
+	}
+	log.Printf("watchdog of %s waits for confirmation until %s", ifce, deadline.Format(time.RFC3339))
+	select {
+	case <-ctx.Done():
+		log.Printf("watchdog of %s is stopped", ifce)
+		return
+	case <-time.After(time.Until(deadline)):
+	}
+
+	pending, err = readPendingConfirm(ifce)
+	if err != nil {
+		return
+	}
+	// the pid is 0 if the watchdog is started but not recorded yet
+	if pending == nil || (pending.PID != 0 && pending.PID != os.Getpid()) {
+		log.Printf("the change of %s is confirmed", ifce)
+		return
+	}
+
+	log.Printf("the change of %s is not confirmed in time", ifce)
+	wgc, err := wgctrl.New()
+	if err != nil {
+		err = fmt.Errorf("cannot obtains wgctrl client: %w", err)
+		return
+	}
+	defer wgc.Close()
+	rerr := pending.Snapshot.restore(wgc)
+	err = os.Remove(pendingConfirmPath(ifce))
+	if err != nil {
+		err = fmt.Errorf("failed to remove confirm state: %w", err)
+	}
+	if rerr != nil {
+		err = fmt.Errorf("rollback failed: %w", rerr)
+		return
+	}
+	log.Printf("the change of %s is rolled back", ifce)
+	return
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/haruue-net/wg-apply/wgconf"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+)
+
+var daemonCmd = &cobra.Command{
+	Use:          "daemon [ INTERFACE | CONFIG_FILE ]",
+	Short:        "Keep re-resolving endpoint hostnames of peers with stale handshakes",
+	RunE:         Daemon,
+	SilenceUsage: true,
+}
+
+// Daemon is the equivalent of reresolve-dns.sh in the contrib of wireguard-tools,
+// only the endpoints are updated, nothing else of the config is applied.
+func Daemon(cmd *cobra.Command, args []string) (err error) {
+	interval := viper.GetDuration("daemon-interval")
+	if interval <= 0 {
+		err = fmt.Errorf("invalid interval %s", interval)
+		return
+	}
+	staleAfter := viper.GetDuration("daemon-stale-handshake")
+
+	resolveOpts, err := resolveOptions()
+	if err != nil {
+		return
+	}
+	// never block the loop, the next try is in the next interval
+	resolveOpts.Retries = 0
+
+	wgc, err := wgctrl.New()
+	if err != nil {
+		err = fmt.Errorf("cannot obtains wgctrl client: %w", err)
+		return
+	}
+	defer wgc.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, unix.SIGTERM)
+	defer cancel()
+
+	conf, err := parseConfig(args)
+	if err != nil {
+		return
+	}
+	fromStdin := viper.GetString("file") == wgconf.StdinPath || len(args) > 0 && args[0] == wgconf.StdinPath
+	log.Printf("re-resolving endpoints of %s every %s for peers without a handshake in %s ...", conf.Interface, interval, staleAfter)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !fromStdin {
+			// pick up changes of the config, but keep the last one on errors
+			newConf, perr := parseConfig(args)
+			if perr != nil {
+				log.Printf("[warn] failed to parse config, the last one is used: %v", perr)
+			} else {
+				conf = newConf
+			}
+		}
+
+		rerr := reresolveEndpoints(ctx, wgc, conf, staleAfter, resolveOpts)
+		if rerr != nil {
+			log.Printf("[warn] %v", rerr)
+		}
+	}
+}
+
+func reresolveEndpoints(ctx context.Context, wgc *wgctrl.Client, conf *wgconf.Config, staleAfter time.Duration, resolveOpts wgconf.ResolveOptions) (err error) {
+	if len(conf.HostEndpoints) == 0 {
+		return
+	}
+	device, err := wgc.Device(conf.Interface)
+	if err != nil {
+		err = fmt.Errorf("failed to get wireguard interface %s: %w", conf.Interface, err)
+		return
+	}
+	for _, peer := range device.Peers {
+		hostEndpoint, ok := conf.HostEndpoints[peer.PublicKey]
+		if !ok {
+			continue
+		}
+		if !peer.LastHandshakeTime.IsZero() && time.Since(peer.LastHandshakeTime) < staleAfter {
+			continue
+		}
+		addr, rerr := wgconf.ResolveEndpoint(ctx, hostEndpoint, resolveOpts)
+		if rerr != nil {
+			log.Printf("[warn] failed to re-resolve endpoint of peer %s: %v", peer.PublicKey, rerr)
+			continue
+		}
+		if peer.Endpoint != nil && peer.Endpoint.IP.Equal(addr.IP) && peer.Endpoint.Port == addr.Port {
+			continue
+		}
+		log.Printf("[#] wg set %s peer %s endpoint %s", conf.Interface, peer.PublicKey, addr)
+		err = wgc.ConfigureDevice(conf.Interface, wgtypes.Config{
+			Peers: []wgtypes.PeerConfig{{
+				PublicKey:  peer.PublicKey,
+				UpdateOnly: true,
+				Endpoint:   addr,
+			}},
+		})
+		if err != nil {
+			err = fmt.Errorf("failed to update endpoint of peer %s: %w", peer.PublicKey, err)
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,80 @@
+package ini
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Editor edits an INI file by lines, so the comments and the order of the
+// untouched lines are kept. The lines are numbered as in Section and Pair,
+// which are never shifted by the insertions.
+type Editor struct {
+	lines    []string
+	values   map[int]string
+	inserts  map[int][]string
+	appended []string
+}
+
+func NewEditor(content []byte) *Editor {
+	content = bytes.TrimSuffix(content, []byte("\n"))
+	var lines []string
+	if len(content) > 0 {
+		lines = strings.Split(string(content), "\n")
+	}
+	return &Editor{
+		lines:   lines,
+		values:  map[int]string{},
+		inserts: map[int][]string{},
+	}
+}
+
+// SetValue replaces the value of the key-value pair at the line, the key and
+// the trailing comment are kept.
+func (e *Editor) SetValue(line int, value string) {
+	e.values[line] = value
+}
+
+// InsertAfter inserts the lines after the line, 0 for the beginning.
+func (e *Editor) InsertAfter(line int, text ...string) {
+	e.inserts[line] = append(e.inserts[line], text...)
+}
+
+// Append appends the lines to the end of the file.
+func (e *Editor) Append(text ...string) {
+	e.appended = append(e.appended, text...)
+}
+
+func (e *Editor) Bytes() []byte {
+	var buf bytes.Buffer
+	writeLines := func(lines []string) {
+		for _, line := range lines {
+			buf.WriteString(line)
+			buf.WriteByte('\n')
+		}
+	}
+	writeLines(e.inserts[0])
+	for i, line := range e.lines {
+		lineNum := i + 1
+		if value, ok := e.values[lineNum]; ok {
+			line = replaceValue(line, value)
+		}
+		writeLines([]string{line})
+		writeLines(e.inserts[lineNum])
+	}
+	writeLines(e.appended)
+	return buf.Bytes()
+}
+
+func replaceValue(line, value string) string {
+	eq := strings.Index(line, "=")
+	if eq == -1 {
+		return line
+	}
+	var comment string
+	if !strings.HasPrefix(strings.TrimSpace(line[eq+1:]), "\"") {
+		if c := strings.Index(line[eq+1:], "#"); c != -1 {
+			comment = " " + line[eq+1+c:]
+		}
+	}
+	return strings.TrimRight(line[:eq], " \t") + " = " + value + comment
+}
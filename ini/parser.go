@@ -2,7 +2,7 @@ package ini
 
 import (
 	"bufio"
-	"errors"
+	"fmt"
 	"io"
 	"strconv"
 	"strings"
@@ -13,19 +13,25 @@ type File []Section
 type Section struct {
 	Name  string
 	Pairs []Pair
+	// File is left to be filled by the caller, as the reader has no name
+	File string
+	Line int
 }
 
 type Pair struct {
 	Key   string
 	Value string
+	Line  int
 }
 
 func ParseINI(reader io.Reader) (file File, err error) {
 	scanner := bufio.NewScanner(reader)
 
 	var currentSection *Section
+	lineNum := 0
 
 	for scanner.Scan() {
+		lineNum++
 		line := strings.TrimSpace(scanner.Text())
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
@@ -33,24 +39,25 @@ func ParseINI(reader io.Reader) (file File, err error) {
 		if strings.HasPrefix(line, "[") {
 			end := strings.Index(line, "]")
 			if end == -1 {
-				err = errors.New("invalid section line: " + line)
+				err = fmt.Errorf("line %d: invalid section line: %s", lineNum, line)
 				return
 			}
 			remaining := strings.TrimSpace(line[end+1:])
 			if remaining != "" && !strings.HasPrefix(remaining, "#") {
-				err = errors.New("invalid section line: " + line)
+				err = fmt.Errorf("line %d: invalid section line: %s", lineNum, line)
 				return
 			}
 			name := strings.TrimSpace(line[1:end])
 			file, currentSection = file.emplaceSection(name)
+			currentSection.Line = lineNum
 		} else {
 			if currentSection == nil {
-				err = errors.New("out of section key-value: " + line)
+				err = fmt.Errorf("line %d: out of section key-value: %s", lineNum, line)
 				return
 			}
 			eq := strings.Index(line, "=")
 			if eq == -1 {
-				err = errors.New("invalid key-value line: " + line)
+				err = fmt.Errorf("line %d: invalid key-value line: %s", lineNum, line)
 				return
 			}
 			key := strings.TrimSpace(line[:eq])
@@ -85,6 +92,7 @@ func ParseINI(reader io.Reader) (file File, err error) {
 			currentSection.Pairs = append(currentSection.Pairs, Pair{
 				Key:   key,
 				Value: value,
+				Line:  lineNum,
 			})
 		}
 	}
@@ -0,0 +1,145 @@
+package lint
+
+import (
+	"fmt"
+	"github.com/haruue-net/wg-apply/netconf"
+	"github.com/haruue-net/wg-apply/wgconf"
+	"net"
+)
+
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// Problem is a semantic problem of a parsed config, Code is stable for
+// machines to match on.
+type Problem struct {
+	Severity Severity `json:"severity"`
+	Code     string   `json:"code"`
+	Message  string   `json:"message"`
+	Peer     string   `json:"peer,omitempty"`
+}
+
+func (p Problem) String() string {
+	if p.Peer != "" {
+		return fmt.Sprintf("%s: [%s] peer %s: %s", p.Severity, p.Code, p.Peer, p.Message)
+	}
+	return fmt.Sprintf("%s: [%s] %s", p.Severity, p.Code, p.Message)
+}
+
+// HasError tells whether there is any problem with SeverityError.
+func HasError(problems []Problem) bool {
+	for _, p := range problems {
+		if p.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// Check reports the semantic problems of conf, which is parsed well but
+// unlikely to work as intended.
+func Check(conf *wgconf.Config) (problems []Problem) {
+	add := func(severity Severity, code, peer, format string, a ...interface{}) {
+		problems = append(problems, Problem{
+			Severity: severity,
+			Code:     code,
+			Message:  fmt.Sprintf(format, a...),
+			Peer:     peer,
+		})
+	}
+
+	for _, w := range conf.Warnings {
+		add(SeverityWarning, w.Code, "", "%s", w.Message)
+	}
+
+	if conf.WireGuard.PrivateKey == nil {
+		add(SeverityError, "missing-private-key", "", "PrivateKey is not set")
+	} else {
+		self := conf.WireGuard.PrivateKey.PublicKey()
+		for _, peer := range conf.WireGuard.Peers {
+			if peer.PublicKey == self {
+				add(SeverityError, "self-peer", peer.PublicKey.String(), "PublicKey is the public key of our own PrivateKey")
+			}
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, peer := range conf.WireGuard.Peers {
+		pubkey := peer.PublicKey.String()
+		if seen[pubkey] {
+			add(SeverityError, "duplicate-public-key", pubkey, "PublicKey is used by more than one peer")
+		}
+		seen[pubkey] = true
+	}
+
+	// a prefix is only routed to one peer, the last one configured wins
+	type owner struct {
+		peer   string
+		prefix net.IPNet
+	}
+	var owners []owner
+	for _, peer := range conf.WireGuard.Peers {
+		pubkey := peer.PublicKey.String()
+		for _, prefix := range peer.AllowedIPs {
+			for _, o := range owners {
+				if o.peer == pubkey || !overlaps(o.prefix, prefix) {
+					continue
+				}
+				if o.prefix.String() == prefix.String() {
+					add(SeverityError, "allowed-ips-duplicate", pubkey, "AllowedIPs %s is also in peer %s, only one of them gets it", prefix.String(), o.peer)
+				} else {
+					add(SeverityWarning, "allowed-ips-overlap", pubkey, "AllowedIPs %s overlaps %s of peer %s", prefix.String(), o.prefix.String(), o.peer)
+				}
+			}
+			owners = append(owners, owner{peer: pubkey, prefix: prefix})
+		}
+	}
+
+	// only the endpoints with an IP address, the hostnames are not resolved
+	// here, wg-apply checks the routes of all endpoints before applying
+	for _, peer := range conf.WireGuard.Peers {
+		if peer.Endpoint == nil {
+			continue
+		}
+		for _, o := range owners {
+			if o.prefix.Contains(peer.Endpoint.IP) {
+				add(SeverityWarning, "endpoint-in-allowed-ips", peer.PublicKey.String(), "Endpoint %s is in AllowedIPs %s of peer %s, so it may be routed into the tunnel itself", peer.Endpoint.IP, o.prefix.String(), o.peer)
+				break
+			}
+		}
+	}
+
+	if network, ok := conf.Network.(*netconf.NetworkConfig); ok {
+		for _, addr := range network.Addresses {
+			subnet := net.IPNet{IP: addr.IP.Mask(addr.Mask), Mask: addr.Mask}
+			routed := false
+			for _, route := range network.Routes {
+				if overlaps(route.Destination, subnet) {
+					routed = true
+					break
+				}
+			}
+			for _, o := range owners {
+				if routed {
+					break
+				}
+				routed = overlaps(o.prefix, subnet)
+			}
+			if !routed {
+				add(SeverityWarning, "address-not-routed", "", "Address %s is not covered by any route or AllowedIPs of peers", addr.String())
+			}
+		}
+	}
+	return
+}
+
+func overlaps(a, b net.IPNet) bool {
+	if (a.IP.To4() == nil) != (b.IP.To4() == nil) {
+		return false
+	}
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
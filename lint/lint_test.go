@@ -0,0 +1,48 @@
+package lint
+
+import (
+	"github.com/haruue-net/wg-apply/wgconf"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestCheckAllowedIPs(t *testing.T) {
+	privkey := wgtypes.Key{9}
+	for _, tc := range []struct {
+		name       string
+		allowedIPs [][]string
+		codes      []string
+	}{
+		{"disjoint", [][]string{{"10.0.0.2/32"}, {"10.0.0.3/32", "fd00::3/128"}}, nil},
+		{"duplicate", [][]string{{"10.0.0.0/24"}, {"10.0.0.0/24"}}, []string{"allowed-ips-duplicate"}},
+		{"overlap", [][]string{{"10.0.0.0/16"}, {"10.0.1.0/24"}}, []string{"allowed-ips-overlap"}},
+		{"overlap wider later", [][]string{{"10.0.1.0/24"}, {"0.0.0.0/0"}}, []string{"allowed-ips-overlap"}},
+		{"same peer", [][]string{{"10.0.0.0/16", "10.0.1.0/24"}}, nil},
+		{"other family", [][]string{{"0.0.0.0/0"}, {"::/0"}}, nil},
+	} {
+		conf := &wgconf.Config{
+			Interface: "wg0",
+			WireGuard: wgtypes.Config{PrivateKey: &privkey},
+		}
+		for i, prefixes := range tc.allowedIPs {
+			peer := wgtypes.PeerConfig{PublicKey: wgtypes.Key{byte(i + 1)}}
+			for _, s := range prefixes {
+				_, prefix, err := net.ParseCIDR(s)
+				if err != nil {
+					t.Fatalf("%s: invalid prefix %s: %v", tc.name, s, err)
+				}
+				peer.AllowedIPs = append(peer.AllowedIPs, *prefix)
+			}
+			conf.WireGuard.Peers = append(conf.WireGuard.Peers, peer)
+		}
+		var codes []string
+		for _, p := range Check(conf) {
+			codes = append(codes, p.Code)
+		}
+		if !reflect.DeepEqual(codes, tc.codes) {
+			t.Errorf("%s: Check() = %q, want %q", tc.name, codes, tc.codes)
+		}
+	}
+}
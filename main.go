@@ -2,18 +2,35 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/haruue-net/wg-apply/netconf"
 	"github.com/haruue-net/wg-apply/wgconf"
 	"github.com/haruue-net/wg-apply/wgdiff"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"golang.org/x/sys/unix"
 	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"log"
+	"net"
+	"net/netip"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
 )
 
 import (
+	_ "github.com/haruue-net/wg-apply/wgconf/ifupdown"
+	_ "github.com/haruue-net/wg-apply/wgconf/native"
+	_ "github.com/haruue-net/wg-apply/wgconf/netplan"
+	_ "github.com/haruue-net/wg-apply/wgconf/networkd"
+	_ "github.com/haruue-net/wg-apply/wgconf/networkmanager"
+	_ "github.com/haruue-net/wg-apply/wgconf/openwrt"
+	_ "github.com/haruue-net/wg-apply/wgconf/wg"
 	_ "github.com/haruue-net/wg-apply/wgconf/wgquick"
 )
 
@@ -24,11 +41,27 @@ var (
 var rootCmd = &cobra.Command{
 	Use:          "wg-apply [ INTERFACE | CONFIG_FILE ]",
 	Version:      Version,
+	Args:         cobra.MaximumNArgs(1),
 	RunE:         Run,
 	SilenceUsage: true,
 }
 
+var downCmd = &cobra.Command{
+	Use:          "down [ INTERFACE | CONFIG_FILE ]",
+	Short:        "Bring the interface down with PreDown and PostDown hooks, as wg-quick down",
+	RunE:         Down,
+	SilenceUsage: true,
+}
+
 func Run(cmd *cobra.Command, args []string) (err error) {
+	if viper.GetBool("list-parsers") {
+		listParsers()
+		return
+	}
+	if viper.GetBool("dry-run") {
+		return Plan(cmd, args)
+	}
+
 	wgc, err := wgctrl.New()
 	if err != nil {
 		err = fmt.Errorf("cannot obtains wgctrl client: %w", err)
@@ -36,10 +69,252 @@ func Run(cmd *cobra.Command, args []string) (err error) {
 	}
 	defer wgc.Close()
 
+	skipNetwork := viper.GetBool("skip-network")
+
+	conf, err := parseConfig(args)
+	if err != nil {
+		return
+	}
+
+	if conf.Network == nil {
+		// the config format has nothing about the network
+		skipNetwork = true
+	}
+	for _, w := range conf.Warnings {
+		log.Printf("[warn] %s", w.Message)
+	}
+	pending, err := readPendingConfirm(conf.Interface)
+	if err != nil {
+		return
+	}
+	if pending != nil {
+		// the rollback would revert this change as well
+		err = fmt.Errorf("a change of %s is waiting for confirmation until %s, run \"wg-apply confirm %s\" first", conf.Interface, pending.Deadline.Format(time.RFC3339), conf.Interface)
+		return
+	}
+
+	action := wgconf.HookActionReload
+	current, derr := wgc.Device(conf.Interface)
+	if errors.Is(derr, os.ErrNotExist) {
+		action = wgconf.HookActionCreate
+	}
+
+	if conf.Save != nil && derr == nil {
+		// keep the runtime changes, such as the peers added by "wg set"
+		err = conf.Save(current)
+		if err != nil {
+			err = fmt.Errorf("failed to save runtime state of %s: %w", conf.Interface, err)
+			return
+		}
+		conf, err = parseConfig(args)
+		if err != nil {
+			return
+		}
+	}
+
+	resolveOpts, err := resolveOptions()
+	if err != nil {
+		return
+	}
+	failed := conf.ResolveEndpoints(context.Background(), resolveOpts)
+	for pubkey, ferr := range failed {
+		log.Printf("[warn] peer %s is applied without an endpoint: %v", pubkey, ferr)
+	}
+
+	if network, ok := conf.Network.(*netconf.NetworkConfig); ok && !skipNetwork {
+		err = checkEndpointLoops(conf, network)
+		if err != nil {
+			return
+		}
+	}
+
+	if runsUpHooks(action) {
+		err = wgconf.RunHooks(conf.Interface, action, conf.Hooks.PreUp)
+		if err != nil {
+			return
+		}
+	}
+
+	snap, err := takeSnapshot(wgc, conf, skipNetwork)
+	if err != nil {
+		err = fmt.Errorf("failed to take snapshot of %s: %w", conf.Interface, err)
+		return
+	}
+	applied := false
+	defer func() {
+		// the stages which have run are rolled back, except the hooks
+		if err == nil || applied || !snap.changed() {
+			return
+		}
+		rerr := snap.restore(wgc)
+		if rerr != nil {
+			err = fmt.Errorf("%w; rollback failed: %v", err, rerr)
+			return
+		}
+		err = fmt.Errorf("%w; rolled back", err)
+	}()
+
+	changed := false
+	if !skipNetwork {
+		netconf.DNSBackend, err = netconf.NewResolverBackend(viper.GetString("dns-backend"))
+		if err != nil {
+			return
+		}
+		snap.NetworkApplied = true
+		changed, err = conf.Network.ApplyNetworkConfig()
+		if err != nil {
+			err = fmt.Errorf("failed to apply network config changes: %w", err)
+			return
+		}
+	}
+
+	device, err := wgc.Device(conf.Interface)
+	if err != nil {
+		var hintSkipNetwork string
+		if skipNetwork && conf.Network != nil {
+			hintSkipNetwork = " (try remove --skip-network or -N flag)"
+		}
+		err = fmt.Errorf("wireguard interface %s is not exist%s: %w", conf.Interface, hintSkipNetwork, err)
+		return
+	}
+	diffOpts, err := diffOptions(conf.Interface)
+	if err != nil {
+		return
+	}
+	diff, err := wgdiff.CalcDiff(device, &conf.WireGuard, diffOpts)
+	if err != nil {
+		err = fmt.Errorf("failed to calculate diff: %w", err)
+		return
+	}
+	changed = changed || !wgdiff.IsEmpty(device, diff)
+	snap.DeviceConfigured = true
+	err = wgc.ConfigureDevice(conf.Interface, *diff)
+	if err != nil {
+		err = fmt.Errorf("failed to apply wireguard config changes: %w", err)
+		return
+	}
+	if werr := writeListenPortState(conf.Interface, conf.WireGuard.ListenPort); werr != nil {
+		log.Printf("[warn] %v", werr)
+	}
+	if werr := writeEndpointState(conf.Interface, &conf.WireGuard); werr != nil {
+		log.Printf("[warn] %v", werr)
+	}
+	if timeout := viper.GetDuration("confirm-timeout"); timeout > 0 {
+		err = startConfirmWatchdog(snap, timeout)
+		if err != nil {
+			return
+		}
+	}
+	applied = true
+
+	if runsUpHooks(action) {
+		err = wgconf.RunHooks(conf.Interface, action, conf.Hooks.PostUp)
+		if err != nil {
+			return
+		}
+	}
+	if action == wgconf.HookActionReload && changed {
+		err = wgconf.RunHooks(conf.Interface, action, conf.Hooks.PostReload)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// runsUpHooks tells if PreUp and PostUp run, which is only on creation as
+// "wg-quick up" does, unless --reload-hooks is set.
+func runsUpHooks(action wgconf.HookAction) bool {
+	return action == wgconf.HookActionCreate || viper.GetBool("reload-hooks")
+}
+
+func Down(cmd *cobra.Command, args []string) (err error) {
+	conf, err := parseConfig(args)
+	if err != nil {
+		return
+	}
+	if conf.Network == nil {
+		err = fmt.Errorf("config of %s has nothing about the network, delete the interface with \"ip link delete dev %s\" instead", conf.Interface, conf.Interface)
+		return
+	}
+
+	pending, err := readPendingConfirm(conf.Interface)
+	if err != nil {
+		return
+	}
+	if pending != nil {
+		// the rollback would bring the interface back after it is deleted
+		err = cancelPendingConfirm(conf.Interface, pending)
+		if err != nil {
+			return
+		}
+		log.Printf("the change of %s waiting for confirmation is cancelled", conf.Interface)
+	}
+
+	err = wgconf.RunHooks(conf.Interface, wgconf.HookActionDown, conf.Hooks.PreDown)
+	if err != nil {
+		return
+	}
+	if conf.Save != nil {
+		err = saveRuntimeState(conf)
+		if err != nil {
+			return
+		}
+	}
+	netconf.DNSBackend, err = netconf.NewResolverBackend(viper.GetString("dns-backend"))
+	if err != nil {
+		return
+	}
+	err = conf.Network.RemoveNetworkConfig()
+	if err != nil {
+		err = fmt.Errorf("failed to bring down %s: %w", conf.Interface, err)
+		return
+	}
+	if werr := writeListenPortState(conf.Interface, nil); werr != nil {
+		log.Printf("[warn] %v", werr)
+	}
+	if werr := writeEndpointState(conf.Interface, nil); werr != nil {
+		log.Printf("[warn] %v", werr)
+	}
+	err = wgconf.RunHooks(conf.Interface, wgconf.HookActionDown, conf.Hooks.PostDown)
+	if err != nil {
+		return
+	}
+	return
+}
+
+// saveRuntimeState keeps the runtime changes, such as the peers added by
+// "wg set", on down as wg-quick does. Nothing is saved if the interface is
+// already gone.
+func saveRuntimeState(conf *wgconf.Config) (err error) {
+	wgc, err := wgctrl.New()
+	if err != nil {
+		err = fmt.Errorf("cannot obtains wgctrl client: %w", err)
+		return
+	}
+	defer wgc.Close()
+
+	device, err := wgc.Device(conf.Interface)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+			return
+		}
+		err = fmt.Errorf("failed to get wireguard interface %s: %w", conf.Interface, err)
+		return
+	}
+	err = conf.Save(device)
+	if err != nil {
+		err = fmt.Errorf("failed to save runtime state of %s: %w", conf.Interface, err)
+		return
+	}
+	return
+}
+
+func parseConfig(args []string) (conf *wgconf.Config, err error) {
 	ifce := viper.GetString("interface")
 	file := viper.GetString("file")
 	parser := viper.GetString("parser")
-	skipNetwork := viper.GetBool("skip-network")
 
 	var extraArg string
 	if len(args) > 0 {
@@ -51,7 +326,7 @@ func Run(cmd *cobra.Command, args []string) (err error) {
 			return
 		}
 		if ifce == "" && file == "" {
-			if strings.ContainsAny(extraArg, "/") {
+			if strings.ContainsAny(extraArg, "/") || extraArg == wgconf.StdinPath {
 				file = extraArg
 			} else {
 				ifce = extraArg
@@ -68,46 +343,286 @@ func Run(cmd *cobra.Command, args []string) (err error) {
 		}
 	}
 
-	conf, err := wgconf.Parse(context.Background(), parser, ifce, file)
+	conf, err = wgconf.Parse(context.Background(), parser, wgconf.ParserOptions{
+		Interface:  ifce,
+		Path:       file,
+		SearchPath: searchPath(),
+	})
+	return
+}
+
+// checkEndpointLoops finds the endpoints routed into the interface itself,
+// which are refused, warned, or bypassed through the uplink of the host as
+// --endpoint-loop says.
+func checkEndpointLoops(conf *wgconf.Config, network *netconf.NetworkConfig) (err error) {
+	mode := viper.GetString("endpoint-loop")
+	if mode != "refuse" && mode != "warn" && mode != "bypass" {
+		err = fmt.Errorf("unknown endpoint loop handling %s, available: refuse, warn, bypass", mode)
+		return
+	}
+
+	var fwmark int
+	if conf.WireGuard.FirewallMark != nil {
+		fwmark = *conf.WireGuard.FirewallMark
+	}
+	var endpoints []net.IP
+	for _, peer := range conf.WireGuard.Peers {
+		if peer.Endpoint != nil {
+			endpoints = append(endpoints, peer.Endpoint.IP)
+		}
+	}
+	loops, err := network.FindEndpointLoops(endpoints, fwmark)
 	if err != nil {
+		err = fmt.Errorf("failed to check endpoint loops: %w", err)
 		return
 	}
 
-	if !skipNetwork {
-		err = conf.Network.ApplyNetworkConfig()
+	var problems []string
+	for _, loop := range loops {
+		var peers, owners []string
+		for _, peer := range conf.WireGuard.Peers {
+			if peer.Endpoint != nil && peer.Endpoint.IP.Equal(loop.Endpoint) {
+				peers = append(peers, peer.PublicKey.String())
+			}
+			for _, prefix := range peer.AllowedIPs {
+				if prefix.Contains(loop.Endpoint) {
+					owners = append(owners, peer.PublicKey.String())
+					break
+				}
+			}
+		}
+		msg := fmt.Sprintf("peer %s on %s: %s", strings.Join(peers, ", "), conf.Interface, loop.String())
+		if len(owners) > 0 {
+			msg += fmt.Sprintf(", which is in AllowedIPs of peer %s", strings.Join(owners, ", "))
+		}
+		msg += ", so the encrypted packets to it would be sent into the tunnel again"
+		if mode == "bypass" {
+			if loop.Bypass == nil {
+				err = fmt.Errorf("%s, and the host has no route to bypass it", msg)
+				return
+			}
+			log.Printf("[warn] %s, bypassed with route %s", msg, loop.Bypass.String())
+			network.BypassRoutes = append(network.BypassRoutes, *loop.Bypass)
+			continue
+		}
+		if loop.Bypass != nil {
+			msg += fmt.Sprintf("; fix it with FwMark and a routing rule, or add route %s with --endpoint-loop=bypass", loop.Bypass.String())
+		} else {
+			msg += "; fix it with FwMark and a routing rule"
+		}
+		problems = append(problems, msg)
+	}
+	if len(problems) == 0 {
+		return
+	}
+	if mode == "warn" {
+		for _, msg := range problems {
+			log.Printf("[warn] %s", msg)
+		}
+		return
+	}
+	err = fmt.Errorf("refuse to apply with routing loops (try --endpoint-loop=warn to apply anyway):\n  %s", strings.Join(problems, "\n  "))
+	return
+}
+
+func listParsers() {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tPRIORITY\tDESCRIPTION")
+	for _, p := range wgconf.Parsers() {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", p.Name, p.Priority, p.Description)
+	}
+	_ = w.Flush()
+}
+
+func resolveOptions() (opts wgconf.ResolveOptions, err error) {
+	opts = wgconf.DefaultResolveOptions()
+	opts.Retries, err = wgconf.ParseRetries(viper.GetString("endpoint-resolution-retries"))
+	if err != nil {
+		return
+	}
+	opts.Backoff = viper.GetDuration("endpoint-resolution-backoff")
+	opts.Family = wgconf.AddressFamily(viper.GetString("endpoint-family"))
+	opts.Resolver = viper.GetString("endpoint-resolver")
+	return
+}
+
+func diffOptions(ifce string) (opts wgdiff.Options, err error) {
+	opts.KeepRoamedEndpoints = viper.GetDuration("keep-roamed-endpoints")
+	opts.Additive = viper.GetBool("additive")
+	opts.UnsetListenPort = wgdiff.ListenPortPolicy(viper.GetString("unset-listen-port"))
+	if opts.UnsetListenPort != wgdiff.ListenPortKeep && opts.UnsetListenPort != wgdiff.ListenPortRandom {
+		err = fmt.Errorf("unknown listen port policy %s, available: %s, %s", opts.UnsetListenPort, wgdiff.ListenPortKeep, wgdiff.ListenPortRandom)
+		return
+	}
+	opts.LastListenPort = readListenPortState(ifce)
+	opts.LastEndpoints = readEndpointState(ifce)
+	return
+}
+
+const endpointStateDir = "/run/wg-apply/endpoints"
+
+// readEndpointState returns the endpoints of the config applied last time,
+// with a line of "PUBLIC_KEY ENDPOINT" for each peer.
+func readEndpointState(ifce string) (endpoints map[wgtypes.Key]*net.UDPAddr) {
+	endpoints = map[wgtypes.Key]*net.UDPAddr{}
+	b, err := os.ReadFile(filepath.Join(endpointStateDir, ifce))
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		pubkey, err := wgtypes.ParseKey(fields[0])
 		if err != nil {
-			err = fmt.Errorf("failed to apply network config changes: %w", err)
+			continue
+		}
+		addrPort, err := netip.ParseAddrPort(fields[1])
+		if err != nil {
+			continue
+		}
+		endpoints[pubkey] = net.UDPAddrFromAddrPort(addrPort)
+	}
+	return
+}
+
+// writeEndpointState records the endpoints of the config applied, the state is
+// removed if conf is nil.
+func writeEndpointState(ifce string, conf *wgtypes.Config) (err error) {
+	statePath := filepath.Join(endpointStateDir, ifce)
+	if conf == nil {
+		err = os.Remove(statePath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			err = fmt.Errorf("failed to remove endpoint state %s: %w", statePath, err)
 			return
 		}
+		err = nil
+		return
+	}
+	var sb strings.Builder
+	for _, peer := range conf.Peers {
+		if peer.Endpoint != nil {
+			sb.WriteString(peer.PublicKey.String() + " " + peer.Endpoint.String() + "\n")
+		}
+	}
+	err = os.MkdirAll(endpointStateDir, 0755)
+	if err != nil {
+		err = fmt.Errorf("failed to create dir %s: %w", endpointStateDir, err)
+		return
+	}
+	err = os.WriteFile(statePath, []byte(sb.String()), 0644)
+	if err != nil {
+		err = fmt.Errorf("failed to write endpoint state %s: %w", statePath, err)
+		return
 	}
+	return
+}
 
-	device, err := wgc.Device(conf.Interface)
+const listenPortStateDir = "/run/wg-apply/listen-port"
+
+// readListenPortState returns the ListenPort of the config applied last time,
+// 0 if it had none.
+func readListenPortState(ifce string) (port int) {
+	b, err := os.ReadFile(filepath.Join(listenPortStateDir, ifce))
 	if err != nil {
-		var hintSkipNetwork string
-		if skipNetwork {
-			hintSkipNetwork = " (try remove --skip-network or -N flag)"
+		return
+	}
+	port, _ = strconv.Atoi(strings.TrimSpace(string(b)))
+	return
+}
+
+// writeListenPortState records the ListenPort of the config applied, the state
+// is removed if port is nil.
+func writeListenPortState(ifce string, port *int) (err error) {
+	statePath := filepath.Join(listenPortStateDir, ifce)
+	if port == nil {
+		err = os.Remove(statePath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			err = fmt.Errorf("failed to remove listen port state %s: %w", statePath, err)
+			return
 		}
-		err = fmt.Errorf("wireguard interface %s is not exist%s: %w", conf.Interface, hintSkipNetwork, err)
+		err = nil
 		return
 	}
-	diff, err := wgdiff.CalcDiff(device, &conf.WireGuard)
+	err = os.MkdirAll(listenPortStateDir, 0755)
 	if err != nil {
-		err = fmt.Errorf("failed to calculate diff: %w", err)
+		err = fmt.Errorf("failed to create dir %s: %w", listenPortStateDir, err)
 		return
 	}
-	err = wgc.ConfigureDevice(conf.Interface, *diff)
+	err = os.WriteFile(statePath, []byte(strconv.Itoa(*port)+"\n"), 0644)
 	if err != nil {
-		err = fmt.Errorf("failed to apply wireguard config changes: %w", err)
+		err = fmt.Errorf("failed to write listen port state %s: %w", statePath, err)
 		return
 	}
 	return
 }
 
+func searchPath() []string {
+	if _, ok := viper.Get("search-path").([]interface{}); ok {
+		// a list in the config file
+		return viper.GetStringSlice("search-path")
+	}
+	return filepath.SplitList(viper.GetString("search-path"))
+}
+
+func initConfig() {
+	configFile := viper.GetString("config")
+	if configFile != "" {
+		viper.SetConfigFile(configFile)
+	} else {
+		viper.SetConfigName("wg-apply")
+		viper.AddConfigPath("/etc/wg-apply")
+	}
+	err := viper.ReadInConfig()
+	if err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); ok && configFile == "" {
+			return
+		}
+		log.Printf("[warn] failed to read config file: %v", err)
+	}
+}
+
 func init() {
+	cobra.OnInitialize(initConfig)
+
+	rootCmd.AddCommand(downCmd)
+	rootCmd.AddCommand(daemonCmd)
+	rootCmd.AddCommand(validateCmd)
+	rootCmd.AddCommand(planCmd)
+	rootCmd.AddCommand(confirmCmd)
+	rootCmd.AddCommand(watchdogCmd)
+
+	validateCmd.Flags().StringP("output", "o", "text", "output format: text, json")
+	_ = viper.BindPFlag("validate-output", validateCmd.Flags().Lookup("output"))
+
+	planCmd.Flags().StringP("output", "o", "text", "output format: text, json")
+	_ = viper.BindPFlag("plan-output", planCmd.Flags().Lookup("output"))
+
+	rootCmd.Flags().BoolP("dry-run", "n", false, "print the changes as \"wg-apply plan\" does, without applying anything")
+	_ = viper.BindPFlag("dry-run", rootCmd.Flags().Lookup("dry-run"))
+
+	rootCmd.Flags().Duration("confirm-timeout", 0, "roll back the change unless \"wg-apply confirm INTERFACE\" is run in this duration, such as 120s")
+	_ = viper.BindPFlag("confirm-timeout", rootCmd.Flags().Lookup("confirm-timeout"))
+
+	daemonCmd.Flags().Duration("interval", 30*time.Second, "interval to check the handshakes")
+	_ = viper.BindPFlag("daemon-interval", daemonCmd.Flags().Lookup("interval"))
+
+	// the same as reresolve-dns.sh, a handshake is expected every 2 minutes
+	daemonCmd.Flags().Duration("stale-handshake", 135*time.Second, "re-resolve the endpoint of peers without a handshake in this duration")
+	_ = viper.BindPFlag("daemon-stale-handshake", daemonCmd.Flags().Lookup("stale-handshake"))
+
+	viper.SetEnvPrefix("wg_apply")
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	viper.AutomaticEnv()
+
+	rootCmd.PersistentFlags().StringP("config", "c", "", "config file of wg-apply itself (default /etc/wg-apply/wg-apply.{yaml,json,toml})")
+	_ = viper.BindPFlag("config", rootCmd.PersistentFlags().Lookup("config"))
+
 	rootCmd.PersistentFlags().StringP("interface", "i", "", "wireguard interface to config")
 	_ = viper.BindPFlag("interface", rootCmd.PersistentFlags().Lookup("interface"))
 
-	rootCmd.PersistentFlags().StringP("file", "f", "", "wireguard config file path")
+	rootCmd.PersistentFlags().StringP("file", "f", "", "wireguard config file path, or - to read from stdin (--interface is required then)")
 	_ = viper.BindPFlag("file", rootCmd.PersistentFlags().Lookup("file"))
 
 	rootCmd.PersistentFlags().StringP("parser", "p", "", "config parser to use")
@@ -115,6 +630,47 @@ func init() {
 
 	rootCmd.PersistentFlags().BoolP("skip-network", "N", false, "skip changes on network adapter (interface, addresses, routes)")
 	_ = viper.BindPFlag("skip-network", rootCmd.PersistentFlags().Lookup("skip-network"))
+
+	rootCmd.PersistentFlags().String("dns-backend", "auto", "how to apply DNS settings: auto, "+strings.Join(netconf.ResolverBackends, ", "))
+	_ = viper.BindPFlag("dns-backend", rootCmd.PersistentFlags().Lookup("dns-backend"))
+
+	defaultRetries := strconv.Itoa(wgconf.DefaultResolveRetries)
+	if retries := os.Getenv("WG_ENDPOINT_RESOLUTION_RETRIES"); retries != "" {
+		// the same env as wg(8)
+		defaultRetries = retries
+	}
+	rootCmd.PersistentFlags().String("endpoint-resolution-retries", defaultRetries, "retries to resolve endpoint hostnames, or infinity")
+	_ = viper.BindPFlag("endpoint-resolution-retries", rootCmd.PersistentFlags().Lookup("endpoint-resolution-retries"))
+
+	rootCmd.PersistentFlags().Duration("endpoint-resolution-backoff", time.Second, "delay before the first retry to resolve endpoints, which grows linearly up to 5 times")
+	_ = viper.BindPFlag("endpoint-resolution-backoff", rootCmd.PersistentFlags().Lookup("endpoint-resolution-backoff"))
+
+	rootCmd.PersistentFlags().String("endpoint-family", string(wgconf.FamilyAny), "address family of endpoints: any, prefer-ipv4, prefer-ipv6, ipv4, ipv6")
+	_ = viper.BindPFlag("endpoint-family", rootCmd.PersistentFlags().Lookup("endpoint-family"))
+
+	rootCmd.PersistentFlags().String("endpoint-resolver", wgconf.ResolverSystem, "resolver of endpoints: system, hosts (/etc/hosts only), or server:ADDRESS")
+	_ = viper.BindPFlag("endpoint-resolver", rootCmd.PersistentFlags().Lookup("endpoint-resolver"))
+
+	rootCmd.PersistentFlags().Duration("keep-roamed-endpoints", 0, "keep the endpoint of peers with a handshake in this duration from another address, such as 135s, 0 to always reset to the configured one")
+	_ = viper.BindPFlag("keep-roamed-endpoints", rootCmd.PersistentFlags().Lookup("keep-roamed-endpoints"))
+
+	rootCmd.PersistentFlags().Bool("additive", false, "keep the runtime values of PresharedKey, PersistentKeepalive, FwMark and ListenPort missing in the config, instead of resetting them")
+	_ = viper.BindPFlag("additive", rootCmd.PersistentFlags().Lookup("additive"))
+
+	rootCmd.PersistentFlags().String("unset-listen-port", string(wgdiff.ListenPortKeep), "when ListenPort is removed from the config: keep the current port, or random to let the kernel pick a new one")
+	_ = viper.BindPFlag("unset-listen-port", rootCmd.PersistentFlags().Lookup("unset-listen-port"))
+
+	rootCmd.PersistentFlags().String("endpoint-loop", "refuse", "when an endpoint is routed into the interface itself: refuse, warn, or bypass (add a route of it through the uplink the host routes it to, following the rules of the host)")
+	_ = viper.BindPFlag("endpoint-loop", rootCmd.PersistentFlags().Lookup("endpoint-loop"))
+
+	rootCmd.PersistentFlags().Bool("reload-hooks", false, "also run PreUp and PostUp on reloads of an existing interface, with $WG_APPLY_ACTION=reload")
+	_ = viper.BindPFlag("reload-hooks", rootCmd.PersistentFlags().Lookup("reload-hooks"))
+
+	rootCmd.PersistentFlags().Bool("list-parsers", false, "list available config parsers in the probing order and exit")
+	_ = viper.BindPFlag("list-parsers", rootCmd.PersistentFlags().Lookup("list-parsers"))
+
+	rootCmd.PersistentFlags().String("search-path", strings.Join(wgconf.DefaultSearchPath, string(filepath.ListSeparator)), "colon-separated dirs to look for wg-quick configs, in order")
+	_ = viper.BindPFlag("search-path", rootCmd.PersistentFlags().Lookup("search-path"))
 }
 
 func main() {
@@ -14,11 +14,38 @@ type NetworkConfig struct {
 	Device    string
 	MTU       *uint32
 	Addresses []net.IPNet
-	Routes    []net.IPNet
+	Routes    []Route
 	Table     *uint32
+	Rules     []Rule
+	DNS       *DNS
+	// BypassRoutes are the routes of endpoints through the uplink, to break
+	// the loops found by FindEndpointLoops
+	BypassRoutes []BypassRoute
+
+	// extraTables are managed besides the tables of Routes, so the routes
+	// in them are deleted when restoring a Snapshot
+	extraTables []uint32
+}
+
+type Route struct {
+	Destination net.IPNet
+	Table       *uint32
+	Metric      *uint32
+}
+
+// Rule is a routing policy rule, which is only added when missing, as there is
+// no way to tell the rules managed by wg-apply from the ones of others.
+type Rule struct {
+	From     *net.IPNet
+	To       *net.IPNet
+	Table    uint32
+	Priority *uint32
+	FwMark   *uint32
 }
 
-func (c *NetworkConfig) ApplyNetworkConfig() (err error) {
+// ApplyNetworkConfig brings the network of the interface to the config,
+// changed tells if anything is changed, as PostReload only runs on changes.
+func (c *NetworkConfig) ApplyNetworkConfig() (changed bool, err error) {
 	conn, err := rtnl.Dial(nil)
 	if err != nil {
 		err = fmt.Errorf("failed to establish netlink conn: %w", err)
@@ -26,7 +53,8 @@ func (c *NetworkConfig) ApplyNetworkConfig() (err error) {
 	}
 	defer conn.Close()
 
-	ifceIdx, err := c.ensureWireGuardInterface(conn.Conn)
+	ifceIdx, linkChanged, err := c.ensureWireGuardInterface(conn.Conn)
+	changed = changed || linkChanged
 	if err != nil {
 		err = fmt.Errorf("failed to ensure wireguard interface: %w", err)
 		return
@@ -36,20 +64,93 @@ func (c *NetworkConfig) ApplyNetworkConfig() (err error) {
 		err = fmt.Errorf("failed to get wireguard interface by index: %w", err)
 		return
 	}
-	err = c.updateAddresses(conn, ifce)
+	stepChanged, err := c.updateAddresses(conn, ifce)
+	changed = changed || stepChanged
 	if err != nil {
 		err = fmt.Errorf("failed to update addresses: %w", err)
 		return
 	}
-	err = c.updateRoutes(conn, ifce)
+	// before the routes, so the endpoints are never routed into the loop
+	stepChanged, err = c.updateBypassRoutes(conn.Conn)
+	changed = changed || stepChanged
+	if err != nil {
+		err = fmt.Errorf("failed to update bypass routes: %w", err)
+		return
+	}
+	stepChanged, err = c.updateRoutes(conn, ifce)
+	changed = changed || stepChanged
 	if err != nil {
 		err = fmt.Errorf("failed to update routes: %w", err)
 		return
 	}
+	stepChanged, err = c.updateRules(conn.Conn)
+	changed = changed || stepChanged
+	if err != nil {
+		err = fmt.Errorf("failed to update rules: %w", err)
+		return
+	}
+	stepChanged, err = c.updateDNS()
+	changed = changed || stepChanged
+	if err != nil {
+		err = fmt.Errorf("failed to update dns: %w", err)
+		return
+	}
+	return
+}
+
+func (c *NetworkConfig) RemoveNetworkConfig() (err error) {
+	// DNS is registered by name, which is not cleaned up with the interface
+	dns := c.DNS
+	c.DNS = nil
+	_, err = c.updateDNS()
+	c.DNS = dns
+	if err != nil {
+		err = fmt.Errorf("failed to remove dns: %w", err)
+		return
+	}
+
+	conn, err := rtnetlink.Dial(nil)
+	if err != nil {
+		err = fmt.Errorf("failed to establish netlink conn: %w", err)
+		return
+	}
+	defer conn.Close()
+
+	bypassRoutes := c.BypassRoutes
+	c.BypassRoutes = nil
+	_, err = c.updateBypassRoutes(conn)
+	c.BypassRoutes = bypassRoutes
+	if err != nil {
+		err = fmt.Errorf("failed to remove bypass routes: %w", err)
+		return
+	}
+
+	links, err := conn.Link.List()
+	if err != nil {
+		err = fmt.Errorf("failed to list interfaces: %w", err)
+		return
+	}
+	for _, link := range links {
+		if link.Attributes.Name != c.Device {
+			continue
+		}
+		if link.Attributes.Info == nil || link.Attributes.Info.Kind != "wireguard" {
+			err = fmt.Errorf("interface %s is not a wireguard interface", c.Device)
+			return
+		}
+		log.Printf("[#] ip link delete dev %s", c.Device)
+		err = conn.Link.Delete(link.Index)
+		if err != nil {
+			err = fmt.Errorf("failed to delete interface %s: %w", c.Device, err)
+			return
+		}
+		return
+	}
+	err = fmt.Errorf("interface %s is not exist", c.Device)
 	return
 }
 
-func (c *NetworkConfig) ensureWireGuardInterface(conn *rtnetlink.Conn) (ifceIndex uint32, err error) {
+func (c *NetworkConfig) ensureWireGuardInterface(conn *rtnetlink.Conn) (ifceIndex uint32, changed bool, err error) {
 	links, err := conn.Link.List()
 	if err != nil {
 		err = fmt.Errorf("failed to list wireguard interfaces: %w", err)
@@ -66,6 +167,7 @@ func (c *NetworkConfig) ensureWireGuardInterface(conn *rtnetlink.Conn) (ifceInde
 			if c.MTU != nil {
 				mtu = *c.MTU
 			}
+			changed = link.Attributes.MTU != mtu || link.Flags&unix.IFF_UP == 0
 			log.Printf("updating wireguard interface %s mtu %d ...", c.Device, mtu)
 			err = conn.Link.Set(&rtnetlink.LinkMessage{
 				Family: unix.AF_UNSPEC,
@@ -78,6 +180,7 @@ func (c *NetworkConfig) ensureWireGuardInterface(conn *rtnetlink.Conn) (ifceInde
 			return
 		}
 	}
+	changed = true
 	ifceIndex, err = c.setupWireGuardInterface(conn)
 	if err != nil {
 		err = fmt.Errorf("failed to setup wireguard interface: %w", err)
@@ -120,14 +223,16 @@ func (c *NetworkConfig) setupWireGuardInterface(conn *rtnetlink.Conn) (ifceIndex
 	return
 }
 
-func (c *NetworkConfig) updateAddresses(conn *rtnl.Conn, ifce *net.Interface) (err error) {
-	addrToString := func(n net.IPNet) string {
-		ones, _ := n.Mask.Size()
-		return fmt.Sprintf("%s/%d", n.IP.String(), ones)
-	}
+func addrToString(n net.IPNet) string {
+	ones, _ := n.Mask.Size()
+	return fmt.Sprintf("%s/%d", n.IP.String(), ones)
+}
 
-	oldAddrs := map[string]net.IPNet{}
-	{
+// diffAddresses returns the addresses to delete and to add, ifce is nil if
+// the interface is not created yet.
+func (c *NetworkConfig) diffAddresses(conn *rtnl.Conn, ifce *net.Interface) (oldAddrs, newAddrs map[string]net.IPNet, err error) {
+	oldAddrs = map[string]net.IPNet{}
+	if ifce != nil {
 		var oas []*net.IPNet
 		oas, err = conn.Addrs(ifce, unix.AF_UNSPEC)
 		if err != nil {
@@ -139,7 +244,7 @@ func (c *NetworkConfig) updateAddresses(conn *rtnl.Conn, ifce *net.Interface) (e
 		}
 	}
 
-	newAddrs := map[string]net.IPNet{}
+	newAddrs = map[string]net.IPNet{}
 	for _, na := range c.Addresses {
 		newAddrs[addrToString(na)] = na
 	}
@@ -156,14 +261,32 @@ addrDedupRouteOuter:
 			}
 		}
 	}
+	return
+}
 
-	for s, addr := range oldAddrs {
-		log.Printf("[#] ip address del %s dev %s", s, c.Device)
-		err = conn.AddrDel(ifce, &addr)
-		if err != nil {
-			err = fmt.Errorf("failed to delete old address %s on interface %s: %w", addr.String(), c.Device, err)
-			return
+func (c *NetworkConfig) updateAddresses(conn *rtnl.Conn, ifce *net.Interface) (changed bool, err error) {
+	oldAddrs, newAddrs, err := c.diffAddresses(conn, ifce)
+	if err != nil {
+		return
+	}
+	changed = len(oldAddrs) > 0 || len(newAddrs) > 0
+	deleteAddrs := func(addrs map[string]net.IPNet) (err error) {
+		for s, addr := range addrs {
+			log.Printf("[#] ip address del %s dev %s", s, c.Device)
+			err = conn.AddrDel(ifce, &addr)
+			if err != nil {
+				err = fmt.Errorf("failed to delete old address %s on interface %s: %w", addr.String(), c.Device, err)
+				return
+			}
 		}
+		return
+	}
+
+	// the new addresses are added before the old ones are deleted, so the
+	// interface is never left without an address, except the conflicting ones
+	err = deleteAddrs(conflictingAddrs(oldAddrs, newAddrs))
+	if err != nil {
+		return
 	}
 
 	for s, addr := range newAddrs {
@@ -175,36 +298,76 @@ addrDedupRouteOuter:
 		}
 	}
 
+	err = deleteAddrs(oldAddrs)
+	if err != nil {
+		return
+	}
+
 	return
 }
 
-func (c *NetworkConfig) updateRoutes(conn *rtnl.Conn, ifce *net.Interface) (err error) {
-	toIPNet := func(route *rtnetlink.RouteMessage) net.IPNet {
-		return net.IPNet{
-			IP:   route.Attributes.Dst,
-			Mask: net.CIDRMask(int(route.DstLength), 8*len(route.Attributes.Dst)),
+// conflictingAddrs moves the addresses which must be deleted before adding
+// newAddrs out of oldAddrs: an ipv6 address is unique regardless of the prefix
+// length, and deleting a primary ipv4 address also deletes the secondary ones
+// in its subnet, unless promote_secondaries is set.
+func conflictingAddrs(oldAddrs, newAddrs map[string]net.IPNet) (conflicting map[string]net.IPNet) {
+	conflicting = map[string]net.IPNet{}
+	for s, oa := range oldAddrs {
+		oldOnes, _ := oa.Mask.Size()
+		for _, na := range newAddrs {
+			newOnes, _ := na.Mask.Size()
+			if (oa.IP.To4() == nil && na.IP.To4() == nil && oa.IP.Equal(na.IP)) ||
+				(oa.IP.To4() != nil && na.IP.To4() != nil && oldOnes == newOnes && oa.Contains(na.IP)) {
+				conflicting[s] = oa
+				delete(oldAddrs, s)
+				break
+			}
 		}
 	}
-	tableOfRoute := func(route *rtnetlink.RouteMessage) (table uint32) {
-		table = route.Attributes.Table
-		if table != 0 {
-			return
-		}
-		table = uint32(route.Table)
-		if table != 0 {
-			return
+	return
+}
+
+type newRoute struct {
+	prefix net.IPNet
+	table  uint32
+	metric uint32
+	// replace is set if a route of the interface with the same prefix, table
+	// and metric exists, but with other attributes, such as a gateway
+	replace bool
+}
+
+// diffRoutes returns the routes to delete and to add or replace, ifce is nil if
+// the interface is not created yet.
+func (c *NetworkConfig) diffRoutes(conn *rtnl.Conn, ifce *net.Interface) (oldRoutes map[string]rtnetlink.RouteMessage, newRoutes map[string]newRoute, err error) {
+	defaultTable := c.defaultTable()
+	routeKey := func(prefix net.IPNet, table, metric uint32) string {
+		key := fmt.Sprintf("%s dev %s table %d", prefix.String(), c.Device, table)
+		if metric != 0 {
+			key += fmt.Sprintf(" metric %d", metric)
 		}
-		table = unix.RT_TABLE_MAIN
-		return
+		return key
 	}
 
-	table := uint32(unix.RT_TABLE_MAIN)
-	if c.Table != nil {
-		table = *c.Table
+	newRoutes = map[string]newRoute{}
+	tables := c.routeTables()
+	for _, na := range c.Routes {
+		nr := newRoute{
+			prefix: na.Destination,
+			table:  defaultTable,
+		}
+		if na.Table != nil {
+			nr.table = *na.Table
+		}
+		if na.Metric != nil && !(na.Destination.IP.To4() == nil && *na.Metric == ipv6DefaultMetric) {
+			// the same as metricOfRoute, the kernel adds an ipv6 route with no
+			// metric as ipv6DefaultMetric
+			nr.metric = *na.Metric
+		}
+		newRoutes[routeKey(nr.prefix, nr.table, nr.metric)] = nr
 	}
 
-	oldRoutes := map[string]rtnetlink.RouteMessage{}
-	{
+	oldRoutes = map[string]rtnetlink.RouteMessage{}
+	if ifce != nil {
 		var oas []rtnetlink.RouteMessage
 		oas, err = listRoute(conn.Conn, ifce)
 		if err != nil {
@@ -216,48 +379,68 @@ func (c *NetworkConfig) updateRoutes(conn *rtnl.Conn, ifce *net.Interface) (err
 				// skip any routes added by kernel or any other routing daemons
 				continue
 			}
-			if tableOfRoute(&oa) == table && oa.Attributes.OutIface == uint32(ifce.Index) {
-				prefix := toIPNet(&oa)
-				oldRoutes[prefix.String()] = oa
+			table := tableOfRoute(&oa)
+			if tables[table] && oa.Attributes.OutIface == uint32(ifce.Index) {
+				oldRoutes[routeKey(prefixOfRoute(&oa), table, metricOfRoute(&oa))] = oa
 			}
 		}
 	}
 
-	newRoutes := map[string]net.IPNet{}
-	for _, na := range c.Routes {
-		newRoutes[na.String()] = na
-	}
-
 routeDedupLoopOuter:
 	for oak := range oldRoutes {
 		for nak := range newRoutes {
 			if oak == nak {
 				// remove common elements, then oldRoutes will be the routes to delete,
-				// and newRoutes will be the routes to add
+				// and newRoutes will be the routes to add or replace
+				oa := oldRoutes[oak]
 				delete(oldRoutes, oak)
-				delete(newRoutes, nak)
+				if routeMatches(&oa) {
+					delete(newRoutes, nak)
+				} else {
+					nr := newRoutes[nak]
+					nr.replace = true
+					newRoutes[nak] = nr
+				}
 				continue routeDedupLoopOuter
 			}
 		}
 	}
+	return
+}
 
-	for s, route := range oldRoutes {
-		log.Printf("[#] ip route del %s dev %s table %d", s, c.Device, table)
-		err = conn.Conn.Route.Delete(&route)
+func (c *NetworkConfig) updateRoutes(conn *rtnl.Conn, ifce *net.Interface) (changed bool, err error) {
+	oldRoutes, newRoutes, err := c.diffRoutes(conn, ifce)
+	if err != nil {
+		return
+	}
+	changed = len(oldRoutes) > 0 || len(newRoutes) > 0
+
+	// the new routes are added before the old ones are deleted, so a prefix
+	// moved to another table or metric, or narrowed, is always routed
+	for s, route := range newRoutes {
+		options := func(ro *rtnl.RouteOptions) {
+			ro.Attrs.Table = route.table
+			ro.Attrs.OutIface = uint32(ifce.Index)
+			ro.Attrs.Priority = route.metric
+		}
+		if route.replace {
+			log.Printf("[#] ip route replace %s", s)
+			err = conn.RouteReplace(ifce, route.prefix, nil, options)
+		} else {
+			log.Printf("[#] ip route add %s", s)
+			err = conn.RouteAdd(ifce, route.prefix, nil, options)
+		}
 		if err != nil {
-			err = fmt.Errorf("failed to delete old route %s on interface %s: %w", s, c.Device, err)
+			err = fmt.Errorf("failed to add new route %s: %w", s, err)
 			return
 		}
 	}
 
-	for s, route := range newRoutes {
-		log.Printf("[#] ip route add %s dev %s table %d", s, c.Device, table)
-		err = conn.RouteAdd(ifce, route, nil, func(ro *rtnl.RouteOptions) {
-			ro.Attrs.Table = table
-			ro.Attrs.OutIface = uint32(ifce.Index)
-		})
+	for s, route := range oldRoutes {
+		log.Printf("[#] ip route del %s", s)
+		err = conn.Conn.Route.Delete(&route)
 		if err != nil {
-			err = fmt.Errorf("failed to add new route %s on interface %s: %w", route.String(), c.Device, err)
+			err = fmt.Errorf("failed to delete old route %s: %w", s, err)
 			return
 		}
 	}
@@ -265,6 +448,62 @@ routeDedupLoopOuter:
 	return
 }
 
+func (c *NetworkConfig) defaultTable() uint32 {
+	if c.Table != nil {
+		return *c.Table
+	}
+	return unix.RT_TABLE_MAIN
+}
+
+// routeTables returns the tables where the routes of the interface are
+// managed, the routes of the interface in other tables are never touched.
+func (c *NetworkConfig) routeTables() (tables map[uint32]bool) {
+	tables = map[uint32]bool{c.defaultTable(): true}
+	for _, route := range c.Routes {
+		if route.Table != nil {
+			tables[*route.Table] = true
+		}
+	}
+	for _, table := range c.extraTables {
+		tables[table] = true
+	}
+	return
+}
+
+// ipv6DefaultMetric is the kernel default metric for ipv6 routes
+const ipv6DefaultMetric = 1024
+
+func metricOfRoute(route *rtnetlink.RouteMessage) (metric uint32) {
+	metric = route.Attributes.Priority
+	if route.Family == unix.AF_INET6 && metric == ipv6DefaultMetric {
+		metric = 0
+	}
+	return
+}
+
+// routeMatches tells if the route is the same as the one updateRoutes adds,
+// besides the prefix, table and metric.
+func routeMatches(route *rtnetlink.RouteMessage) bool {
+	scope := uint8(unix.RT_SCOPE_LINK)
+	if route.Family == unix.AF_INET6 {
+		scope = unix.RT_SCOPE_UNIVERSE
+	}
+	return route.Type == unix.RTN_UNICAST && route.Scope == scope && route.Attributes.Gateway == nil
+}
+
+func tableOfRoute(route *rtnetlink.RouteMessage) (table uint32) {
+	table = route.Attributes.Table
+	if table != 0 {
+		return
+	}
+	table = uint32(route.Table)
+	if table != 0 {
+		return
+	}
+	table = unix.RT_TABLE_MAIN
+	return
+}
+
 func listRoute(conn *rtnetlink.Conn, ifce *net.Interface) (routes []rtnetlink.RouteMessage, err error) {
 	for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
 		req := &rtnetlink.RouteMessage{
@@ -0,0 +1,295 @@
+package netconf
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+type DNS struct {
+	Servers []net.IP
+	Search  []string
+}
+
+// ResolverBackend registers the DNS settings of an interface to the system
+// resolver.
+type ResolverBackend interface {
+	Name() string
+	// Set registers dns for the interface, replacing the one set before
+	Set(ifce string, dns *DNS) error
+	// Unset removes what Set registered for the interface
+	Unset(ifce string) error
+}
+
+// DNSBackend is used to apply the DNS settings, the backend is detected
+// automatically if nil.
+var DNSBackend ResolverBackend
+
+// ResolverBackends is the backends accepted by NewResolverBackend, besides
+// "auto".
+var ResolverBackends = []string{"resolvconf", "file"}
+
+const (
+	resolvConfPath = "/etc/resolv.conf"
+	dnsStateDir    = "/run/wg-apply/dns"
+)
+
+// NewResolverBackend returns the backend by name, "auto" uses resolvconf(8)
+// if installed, or falls back to write /etc/resolv.conf directly.
+func NewResolverBackend(name string) (backend ResolverBackend, err error) {
+	switch name {
+	case "", "auto":
+		if p, lerr := exec.LookPath("resolvconf"); lerr == nil {
+			backend = &resolvconfBackend{path: p}
+		} else {
+			backend = &fileBackend{path: resolvConfPath}
+		}
+	case "resolvconf":
+		var p string
+		p, err = exec.LookPath("resolvconf")
+		if err != nil {
+			err = fmt.Errorf("resolvconf is not installed: %w", err)
+			return
+		}
+		backend = &resolvconfBackend{path: p}
+	case "file":
+		backend = &fileBackend{path: resolvConfPath}
+	default:
+		err = fmt.Errorf("unknown dns backend %s, available: auto, %s", name, strings.Join(ResolverBackends, ", "))
+	}
+	return
+}
+
+func (d *DNS) isEmpty() bool {
+	return d == nil || len(d.Servers) == 0 && len(d.Search) == 0
+}
+
+// render returns the settings in the format of resolv.conf(5)
+func (d *DNS) render() string {
+	var sb strings.Builder
+	for _, server := range d.Servers {
+		sb.WriteString("nameserver " + server.String() + "\n")
+	}
+	if len(d.Search) > 0 {
+		sb.WriteString("search " + strings.Join(d.Search, " ") + "\n")
+	}
+	return sb.String()
+}
+
+// updateDNS compares the settings with the ones applied last time, which are
+// recorded in dnsStateDir, so the resolver is only touched on changes.
+func (c *NetworkConfig) updateDNS() (changed bool, err error) {
+	backend := DNSBackend
+	if backend == nil {
+		backend, err = NewResolverBackend("auto")
+		if err != nil {
+			return
+		}
+	}
+
+	statePath := filepath.Join(dnsStateDir, c.Device)
+	oldBackend, oldContent, err := readDNSState(statePath)
+	if err != nil {
+		err = fmt.Errorf("failed to read dns state %s: %w", statePath, err)
+		return
+	}
+
+	var newContent string
+	if !c.DNS.isEmpty() {
+		newContent = c.DNS.render()
+	}
+	if oldBackend == backend.Name() && oldContent == newContent {
+		return
+	}
+	changed = oldContent != newContent
+
+	if oldBackend != "" && oldBackend != backend.Name() {
+		// the backend is changed, clean up with the old one
+		var old ResolverBackend
+		old, err = NewResolverBackend(oldBackend)
+		if err == nil {
+			err = old.Unset(c.Device)
+		}
+		if err != nil {
+			log.Printf("[warn] failed to unset dns of %s with backend %s: %v", c.Device, oldBackend, err)
+			err = nil
+		}
+		oldContent = ""
+	}
+
+	if newContent == "" {
+		if oldContent != "" {
+			err = backend.Unset(c.Device)
+			if err != nil {
+				return
+			}
+		}
+		err = os.Remove(statePath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			err = fmt.Errorf("failed to remove dns state %s: %w", statePath, err)
+			return
+		}
+		err = nil
+		return
+	}
+
+	err = backend.Set(c.Device, c.DNS)
+	if err != nil {
+		return
+	}
+	err = os.MkdirAll(dnsStateDir, 0755)
+	if err != nil {
+		err = fmt.Errorf("failed to create dir %s: %w", dnsStateDir, err)
+		return
+	}
+	err = os.WriteFile(statePath, []byte("# backend "+backend.Name()+"\n"+newContent), 0644)
+	if err != nil {
+		err = fmt.Errorf("failed to write dns state %s: %w", statePath, err)
+		return
+	}
+	return
+}
+
+func readDNSState(statePath string) (backend, content string, err error) {
+	b, err := os.ReadFile(statePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+		return
+	}
+	header, content, _ := strings.Cut(string(b), "\n")
+	backend = strings.TrimPrefix(header, "# backend ")
+	return
+}
+
+// resolvconfBackend registers the settings with resolvconf(8) exclusively,
+// the same as wg-quick(8).
+type resolvconfBackend struct {
+	path string
+}
+
+func (b *resolvconfBackend) Name() string {
+	return "resolvconf"
+}
+
+func (b *resolvconfBackend) Set(ifce string, dns *DNS) (err error) {
+	name := resolvconfIfacePrefix() + ifce
+	log.Printf("[#] resolvconf -a %s -m 0 -x", name)
+	cmd := exec.Command(b.path, "-a", name, "-m", "0", "-x")
+	cmd.Stdin = strings.NewReader(dns.render())
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("resolvconf -a %s failed: %w: %s", name, err, bytes.TrimSpace(output))
+		return
+	}
+	return
+}
+
+func (b *resolvconfBackend) Unset(ifce string) (err error) {
+	name := resolvconfIfacePrefix() + ifce
+	log.Printf("[#] resolvconf -d %s -f", name)
+	output, err := exec.Command(b.path, "-d", name, "-f").CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("resolvconf -d %s failed: %w: %s", name, err, bytes.TrimSpace(output))
+		return
+	}
+	return
+}
+
+var interfaceOrderRegexp = regexp.MustCompile(`^([A-Za-z0-9-]+)\*$`)
+
+// resolvconfIfacePrefix follows wg-quick(8), so the interface is ordered as a
+// tunnel by Debian's resolvconf.
+func resolvconfIfacePrefix() string {
+	f, err := os.Open("/etc/resolvconf/interface-order")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if m := interfaceOrderRegexp.FindStringSubmatch(scanner.Text()); m != nil {
+			return m[1] + "."
+		}
+	}
+	return ""
+}
+
+// fileBackend overwrites /etc/resolv.conf, the original one is moved to a
+// backup on the first Set, and moved back on Unset. Only one interface can
+// own the file at a time, or the backups would be restored in a wrong order.
+type fileBackend struct {
+	path string
+}
+
+func (b *fileBackend) Name() string {
+	return "file"
+}
+
+func (b *fileBackend) backupPath(ifce string) string {
+	return b.path + ".wg-apply-" + ifce
+}
+
+func (b *fileBackend) Set(ifce string, dns *DNS) (err error) {
+	backupPath := b.backupPath(ifce)
+	backups, err := filepath.Glob(b.backupPath("*"))
+	if err != nil {
+		return
+	}
+	for _, p := range backups {
+		if p != backupPath {
+			err = fmt.Errorf("%s is already managed by wg-apply for %s, remove the dns of it first or use the resolvconf backend", b.path, strings.TrimPrefix(p, b.backupPath("")))
+			return
+		}
+	}
+	if _, serr := os.Lstat(backupPath); errors.Is(serr, os.ErrNotExist) {
+		// rename keeps the original as is, even if it is a symlink
+		log.Printf("[#] mv %s %s", b.path, backupPath)
+		err = os.Rename(b.path, backupPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			err = fmt.Errorf("failed to backup %s: %w", b.path, err)
+			return
+		}
+		err = nil
+	}
+
+	log.Printf("[#] write %s", b.path)
+	content := fmt.Sprintf("# generated by wg-apply for %s, the original one is at %s\n", ifce, backupPath) + dns.render()
+	tmpPath := b.path + ".wg-apply.tmp"
+	err = os.WriteFile(tmpPath, []byte(content), 0644)
+	if err != nil {
+		err = fmt.Errorf("failed to write %s: %w", tmpPath, err)
+		return
+	}
+	err = os.Rename(tmpPath, b.path)
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		err = fmt.Errorf("failed to replace %s: %w", b.path, err)
+		return
+	}
+	return
+}
+
+func (b *fileBackend) Unset(ifce string) (err error) {
+	backupPath := b.backupPath(ifce)
+	if _, serr := os.Lstat(backupPath); errors.Is(serr, os.ErrNotExist) {
+		log.Printf("[warn] no backup %s to restore %s from", backupPath, b.path)
+		return
+	}
+	log.Printf("[#] mv %s %s", backupPath, b.path)
+	err = os.Rename(backupPath, b.path)
+	if err != nil {
+		err = fmt.Errorf("failed to restore %s from %s: %w", b.path, backupPath, err)
+		return
+	}
+	return
+}
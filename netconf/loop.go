@@ -0,0 +1,479 @@
+package netconf
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jsimonetti/rtnetlink"
+	"golang.org/x/sys/unix"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// EndpointLoop is an endpoint of a peer which is routed into the wireguard
+// interface itself, so the encrypted packets to it never leave the host.
+type EndpointLoop struct {
+	Endpoint net.IP
+	// Route is the route of the config which catches the endpoint
+	Route net.IPNet
+	Table uint32
+	// Bypass routes the endpoint as the host does without the interface, nil
+	// if the host has no route to it either
+	Bypass *BypassRoute
+}
+
+func (l *EndpointLoop) String() string {
+	s := fmt.Sprintf("endpoint %s is routed into the interface itself by route %s table %d", l.Endpoint, l.Route.String(), l.Table)
+	if l.Table != unix.RT_TABLE_MAIN {
+		s += " through the routing rules"
+	}
+	return s
+}
+
+// BypassRoute is a route of an endpoint through the uplink of the host, which
+// is more specific than the routes into the wireguard interface.
+type BypassRoute struct {
+	Destination net.IPNet
+	Gateway     net.IP
+	Device      string
+	Table       uint32
+}
+
+func (r *BypassRoute) String() string {
+	s := r.Destination.String()
+	if r.Gateway != nil {
+		s += " via " + r.Gateway.String()
+	}
+	return s + fmt.Sprintf(" dev %s table %d", r.Device, r.Table)
+}
+
+const bypassStateDir = "/run/wg-apply/bypass"
+
+// FindEndpointLoops checks the endpoints against the routes and rules of the
+// config, as well as the current routing table of the host, which may have a
+// more specific route to the endpoint. Packets of the interface are marked
+// with fwmark, so the rules not matching it never catch them.
+func (c *NetworkConfig) FindEndpointLoops(endpoints []net.IP, fwmark int) (loops []EndpointLoop, err error) {
+	conn, err := rtnetlink.Dial(nil)
+	if err != nil {
+		err = fmt.Errorf("failed to establish netlink conn: %w", err)
+		return
+	}
+	defer conn.Close()
+
+	hostRoutes, err := conn.Route.List()
+	if err != nil {
+		err = fmt.Errorf("failed to list routes: %w", err)
+		return
+	}
+	var ifceIndex uint32
+	if ifce, ierr := net.InterfaceByName(c.Device); ierr == nil {
+		ifceIndex = uint32(ifce.Index)
+	}
+	// the bypass routes added before must not hide the loops
+	oldBypass, err := readBypassState(filepath.Join(bypassStateDir, c.Device))
+	if err != nil {
+		return
+	}
+	bypassed := map[string]bool{}
+	for _, route := range oldBypass {
+		bypassed[bypassKey(route.Destination, route.Gateway, route.Table)] = true
+	}
+
+	// lookupHost finds the most specific route to ip in the table, skipping
+	// the routes of the interface
+	lookupHost := func(ip net.IP, table uint32) (best *rtnetlink.RouteMessage) {
+		for i := range hostRoutes {
+			route := &hostRoutes[i]
+			if route.Type != unix.RTN_UNICAST || tableOfRoute(route) != table || route.Attributes.OutIface == 0 {
+				continue
+			}
+			if ifceIndex != 0 && route.Attributes.OutIface == ifceIndex {
+				continue
+			}
+			if (route.Family == unix.AF_INET) != (ip.To4() != nil) {
+				continue
+			}
+			prefix := prefixOfRoute(route)
+			if !prefix.Contains(ip) {
+				continue
+			}
+			if bypassed[bypassKey(prefix, route.Attributes.Gateway, table)] {
+				continue
+			}
+			if best == nil || route.DstLength > best.DstLength ||
+				route.DstLength == best.DstLength && route.Attributes.Priority < best.Attributes.Priority {
+				best = route
+			}
+		}
+		return
+	}
+
+	defaultTable := uint32(unix.RT_TABLE_MAIN)
+	if c.Table != nil {
+		defaultTable = *c.Table
+	}
+	tableReached := func(ip net.IP, table uint32) bool {
+		if table == unix.RT_TABLE_MAIN {
+			return true
+		}
+		for _, rule := range c.Rules {
+			if rule.Table != table || rule.From != nil {
+				// the source address is chosen by the routing, which is unknown here
+				continue
+			}
+			if rule.To != nil && !rule.To.Contains(ip) {
+				continue
+			}
+			if rule.FwMark != nil && *rule.FwMark != uint32(fwmark) {
+				continue
+			}
+			return true
+		}
+		return false
+	}
+
+	seen := map[string]bool{}
+	for _, ip := range endpoints {
+		if ip == nil || seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+
+		var loop *EndpointLoop
+		for _, route := range c.Routes {
+			table := defaultTable
+			if route.Table != nil {
+				table = *route.Table
+			}
+			if !route.Destination.Contains(ip) || !tableReached(ip, table) {
+				continue
+			}
+			ones, _ := route.Destination.Mask.Size()
+			if loop != nil {
+				if bestOnes, _ := loop.Route.Mask.Size(); bestOnes >= ones {
+					continue
+				}
+			}
+			if host := lookupHost(ip, table); host != nil && int(host.DstLength) > ones {
+				// the host has a more specific route to the endpoint
+				continue
+			}
+			loop = &EndpointLoop{
+				Endpoint: ip,
+				Route:    route.Destination,
+				Table:    table,
+			}
+		}
+		if loop == nil {
+			continue
+		}
+
+		host := uplinkRoute(conn, ip, fwmark, ifceIndex)
+		if host == nil {
+			// routed into the interface already, or unreachable for now
+			host = lookupHost(ip, unix.RT_TABLE_MAIN)
+		}
+		if host != nil {
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			bypass := &BypassRoute{
+				Destination: net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)},
+				Gateway:     host.Attributes.Gateway,
+				Table:       loop.Table,
+			}
+			if uplink, ierr := net.InterfaceByIndex(int(host.Attributes.OutIface)); ierr == nil {
+				bypass.Device = uplink.Name
+				loop.Bypass = bypass
+			}
+		}
+		loops = append(loops, *loop)
+	}
+	return
+}
+
+// uplinkRoute asks the kernel for the route of the encrypted packets to ip,
+// which are marked with fwmark, so the rules of the host are followed. It is
+// nil if the packets go into the interface, or the lookup fails.
+func uplinkRoute(conn *rtnetlink.Conn, ip net.IP, fwmark int, ifceIndex uint32) (route *rtnetlink.RouteMessage) {
+	family := uint8(unix.AF_INET6)
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		family = unix.AF_INET
+		bits = 8 * net.IPv4len
+		ip = ip4
+	}
+	routes, err := conn.Route.Get(&rtnetlink.RouteMessage{
+		Family:    family,
+		DstLength: uint8(bits),
+		Attributes: rtnetlink.RouteAttributes{
+			Dst:  ip,
+			Mark: uint32(fwmark),
+		},
+	})
+	if err != nil || len(routes) == 0 {
+		return
+	}
+	route = &routes[0]
+	if route.Type != unix.RTN_UNICAST || route.Attributes.OutIface == 0 ||
+		(ifceIndex != 0 && route.Attributes.OutIface == ifceIndex) {
+		route = nil
+		return
+	}
+	return
+}
+
+// updateBypassRoutes adds BypassRoutes to the host, and deletes the ones added
+// last time but no longer needed, which are recorded in bypassStateDir as they
+// are not on the wireguard interface.
+func (c *NetworkConfig) updateBypassRoutes(conn *rtnetlink.Conn) (changed bool, err error) {
+	statePath := filepath.Join(bypassStateDir, c.Device)
+	oldRoutes, newRoutes, err := c.diffBypassRoutes()
+	if err != nil {
+		return
+	}
+
+	// the new routes are added before the old ones are deleted, and a route
+	// through another gateway is replaced in place, so the endpoints are
+	// always routed
+	replaced := bypassReplacements(oldRoutes, newRoutes)
+	for s, route := range newRoutes {
+		if _, ok := oldRoutes[s]; ok {
+			continue
+		}
+		changed = true
+		var msg *rtnetlink.RouteMessage
+		msg, err = route.message()
+		if _, ok := replaced[s]; ok {
+			log.Printf("[#] ip route replace %s", s)
+			if err == nil {
+				err = conn.Route.Replace(msg)
+			}
+		} else {
+			log.Printf("[#] ip route add %s", s)
+			if err == nil {
+				err = conn.Route.Add(msg)
+			}
+		}
+		if err != nil && !errors.Is(err, unix.EEXIST) && !errors.Is(err, os.ErrExist) {
+			err = fmt.Errorf("failed to add bypass route %s: %w", s, err)
+			return
+		}
+		err = nil
+	}
+	for s, route := range oldRoutes {
+		if _, ok := newRoutes[s]; ok {
+			continue
+		}
+		changed = true
+		if replacedRoute(replaced, s) {
+			continue
+		}
+		msg, merr := route.message()
+		if merr != nil {
+			// the uplink is gone, so is the route
+			log.Printf("[warn] skip deleting bypass route %s: %v", s, merr)
+			continue
+		}
+		log.Printf("[#] ip route del %s", s)
+		err = conn.Route.Delete(msg)
+		if err != nil && !errors.Is(err, unix.ESRCH) && !errors.Is(err, os.ErrNotExist) {
+			err = fmt.Errorf("failed to delete bypass route %s: %w", s, err)
+			return
+		}
+		err = nil
+	}
+	if !changed {
+		return
+	}
+
+	if len(newRoutes) == 0 {
+		err = os.Remove(statePath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			err = fmt.Errorf("failed to remove bypass state %s: %w", statePath, err)
+			return
+		}
+		err = nil
+		return
+	}
+	var sb strings.Builder
+	for s := range newRoutes {
+		sb.WriteString(s + "\n")
+	}
+	err = os.MkdirAll(bypassStateDir, 0755)
+	if err != nil {
+		err = fmt.Errorf("failed to create dir %s: %w", bypassStateDir, err)
+		return
+	}
+	err = os.WriteFile(statePath, []byte(sb.String()), 0644)
+	if err != nil {
+		err = fmt.Errorf("failed to write bypass state %s: %w", statePath, err)
+		return
+	}
+	return
+}
+
+// diffBypassRoutes returns the bypass routes added last time and the ones to
+// add now, keyed by BypassRoute.String, the routes in both are kept.
+func (c *NetworkConfig) diffBypassRoutes() (oldRoutes, newRoutes map[string]BypassRoute, err error) {
+	statePath := filepath.Join(bypassStateDir, c.Device)
+	oldBypass, err := readBypassState(statePath)
+	if err != nil {
+		return
+	}
+	oldRoutes = map[string]BypassRoute{}
+	for _, route := range oldBypass {
+		oldRoutes[route.String()] = route
+	}
+	newRoutes = map[string]BypassRoute{}
+	for _, route := range c.BypassRoutes {
+		newRoutes[route.String()] = route
+	}
+	return
+}
+
+// bypassReplacements returns the old routes replaced in place by the new ones
+// through another gateway or uplink, keyed by the new ones, as the kernel only
+// tells the routes apart by the destination and the table.
+func bypassReplacements(oldRoutes, newRoutes map[string]BypassRoute) (replaced map[string]string) {
+	replaced = map[string]string{}
+	for newKey, route := range newRoutes {
+		if _, ok := oldRoutes[newKey]; ok {
+			continue
+		}
+		for oldKey, old := range oldRoutes {
+			if _, ok := newRoutes[oldKey]; ok || replacedRoute(replaced, oldKey) {
+				continue
+			}
+			if old.Destination.String() == route.Destination.String() && old.Table == route.Table {
+				replaced[newKey] = oldKey
+				break
+			}
+		}
+	}
+	return
+}
+
+func replacedRoute(replaced map[string]string, old string) bool {
+	for _, s := range replaced {
+		if s == old {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *BypassRoute) message() (msg *rtnetlink.RouteMessage, err error) {
+	uplink, err := net.InterfaceByName(r.Device)
+	if err != nil {
+		err = fmt.Errorf("failed to get interface %s: %w", r.Device, err)
+		return
+	}
+	family := uint8(unix.AF_INET6)
+	dst := r.Destination.IP
+	if ip4 := dst.To4(); ip4 != nil {
+		family = unix.AF_INET
+		dst = ip4
+	}
+	ones, _ := r.Destination.Mask.Size()
+	scope := uint8(unix.RT_SCOPE_UNIVERSE)
+	if r.Gateway == nil {
+		scope = unix.RT_SCOPE_LINK
+	}
+	msg = &rtnetlink.RouteMessage{
+		Family:    family,
+		DstLength: uint8(ones),
+		Table:     unix.RT_TABLE_UNSPEC,
+		Protocol:  unix.RTPROT_BOOT,
+		Scope:     scope,
+		Type:      unix.RTN_UNICAST,
+		Attributes: rtnetlink.RouteAttributes{
+			Dst:      dst,
+			Gateway:  r.Gateway,
+			OutIface: uint32(uplink.Index),
+			Table:    r.Table,
+		},
+	}
+	return
+}
+
+// parseBypassRoute parses the output of BypassRoute.String
+func parseBypassRoute(s string) (route BypassRoute, err error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		err = errors.New("empty route")
+		return
+	}
+	_, dst, err := net.ParseCIDR(fields[0])
+	if err != nil {
+		return
+	}
+	route.Destination = *dst
+	for i := 1; i+1 < len(fields); i += 2 {
+		switch fields[i] {
+		case "via":
+			route.Gateway = net.ParseIP(fields[i+1])
+		case "dev":
+			route.Device = fields[i+1]
+		case "table":
+			var table uint64
+			table, err = strconv.ParseUint(fields[i+1], 10, 32)
+			if err != nil {
+				return
+			}
+			route.Table = uint32(table)
+		}
+	}
+	if route.Device == "" || route.Table == 0 {
+		err = errors.New("missing dev or table")
+		return
+	}
+	return
+}
+
+// readBypassState returns the bypass routes added last time
+func readBypassState(statePath string) (routes []BypassRoute, err error) {
+	b, err := os.ReadFile(statePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+			return
+		}
+		err = fmt.Errorf("failed to read bypass state %s: %w", statePath, err)
+		return
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		route, perr := parseBypassRoute(line)
+		if perr != nil {
+			log.Printf("[warn] invalid bypass route %q in %s: %v", line, statePath, perr)
+			continue
+		}
+		routes = append(routes, route)
+	}
+	return
+}
+
+func bypassKey(prefix net.IPNet, gateway net.IP, table uint32) string {
+	return fmt.Sprintf("%s via %s table %d", prefix.String(), gateway, table)
+}
+
+func prefixOfRoute(route *rtnetlink.RouteMessage) net.IPNet {
+	bits := 8 * net.IPv4len
+	if route.Family == unix.AF_INET6 {
+		bits = 8 * net.IPv6len
+	}
+	dst := route.Attributes.Dst
+	if dst == nil {
+		dst = make(net.IP, bits/8)
+	}
+	return net.IPNet{IP: dst, Mask: net.CIDRMask(int(route.DstLength), bits)}
+}
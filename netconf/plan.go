@@ -0,0 +1,204 @@
+package netconf
+
+import (
+	"fmt"
+	"github.com/jsimonetti/rtnetlink"
+	"github.com/jsimonetti/rtnetlink/rtnl"
+	"golang.org/x/sys/unix"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Change is a change ApplyNetworkConfig would make, Command is in the form
+// of ip(8) for the link, addresses, routes and rules.
+type Change struct {
+	Kind    string `json:"kind"`
+	Action  string `json:"action"`
+	Command string `json:"command"`
+}
+
+const (
+	ChangeKindLink        = "link"
+	ChangeKindAddress     = "address"
+	ChangeKindRoute       = "route"
+	ChangeKindBypassRoute = "bypass-route"
+	ChangeKindRule        = "rule"
+	ChangeKindDNS         = "dns"
+
+	ChangeActionAdd     = "add"
+	ChangeActionDelete  = "delete"
+	ChangeActionReplace = "replace"
+	ChangeActionSet     = "set"
+)
+
+// PlanNetworkConfig computes the changes of ApplyNetworkConfig in the same
+// order, without touching anything.
+func (c *NetworkConfig) PlanNetworkConfig() (changes []Change, err error) {
+	conn, err := rtnl.Dial(nil)
+	if err != nil {
+		err = fmt.Errorf("failed to establish netlink conn: %w", err)
+		return
+	}
+	defer conn.Close()
+
+	add := func(kind, action, format string, a ...interface{}) {
+		changes = append(changes, Change{
+			Kind:    kind,
+			Action:  action,
+			Command: fmt.Sprintf(format, a...),
+		})
+	}
+
+	mtu := uint32(1420)
+	if c.MTU != nil {
+		mtu = *c.MTU
+	}
+	links, err := conn.Conn.Link.List()
+	if err != nil {
+		err = fmt.Errorf("failed to list interfaces: %w", err)
+		return
+	}
+	var link *rtnetlink.LinkMessage
+	for i := range links {
+		if links[i].Attributes.Name == c.Device {
+			link = &links[i]
+			break
+		}
+	}
+	var ifce *net.Interface
+	if link == nil {
+		add(ChangeKindLink, ChangeActionAdd, "ip link add dev %s mtu %d up type wireguard", c.Device, mtu)
+	} else {
+		if link.Attributes.Info == nil || link.Attributes.Info.Kind != "wireguard" {
+			err = fmt.Errorf("interface %s is not a wireguard interface", c.Device)
+			return
+		}
+		if link.Attributes.MTU != mtu || link.Flags&unix.IFF_UP == 0 {
+			add(ChangeKindLink, ChangeActionSet, "ip link set dev %s mtu %d up", c.Device, mtu)
+		}
+		ifce, err = conn.LinkByIndex(int(link.Index))
+		if err != nil {
+			err = fmt.Errorf("failed to get wireguard interface by index: %w", err)
+			return
+		}
+	}
+
+	oldAddrs, newAddrs, err := c.diffAddresses(conn, ifce)
+	if err != nil {
+		return
+	}
+	for _, s := range sortedKeys(conflictingAddrs(oldAddrs, newAddrs)) {
+		add(ChangeKindAddress, ChangeActionDelete, "ip address del %s dev %s", s, c.Device)
+	}
+	for _, s := range sortedKeys(newAddrs) {
+		add(ChangeKindAddress, ChangeActionAdd, "ip address add %s dev %s", s, c.Device)
+	}
+	for _, s := range sortedKeys(oldAddrs) {
+		add(ChangeKindAddress, ChangeActionDelete, "ip address del %s dev %s", s, c.Device)
+	}
+
+	oldBypass, newBypass, err := c.diffBypassRoutes()
+	if err != nil {
+		return
+	}
+	replacedBypass := bypassReplacements(oldBypass, newBypass)
+	for _, s := range sortedKeys(newBypass) {
+		if _, ok := oldBypass[s]; ok {
+			continue
+		}
+		if _, ok := replacedBypass[s]; ok {
+			add(ChangeKindBypassRoute, ChangeActionReplace, "ip route replace %s", s)
+		} else {
+			add(ChangeKindBypassRoute, ChangeActionAdd, "ip route add %s", s)
+		}
+	}
+	for _, s := range sortedKeys(oldBypass) {
+		if _, ok := newBypass[s]; !ok && !replacedRoute(replacedBypass, s) {
+			add(ChangeKindBypassRoute, ChangeActionDelete, "ip route del %s", s)
+		}
+	}
+
+	oldRoutes, newRoutes, err := c.diffRoutes(conn, ifce)
+	if err != nil {
+		return
+	}
+	for _, s := range sortedKeys(newRoutes) {
+		if newRoutes[s].replace {
+			add(ChangeKindRoute, ChangeActionReplace, "ip route replace %s", s)
+		} else {
+			add(ChangeKindRoute, ChangeActionAdd, "ip route add %s", s)
+		}
+	}
+	for _, s := range sortedKeys(oldRoutes) {
+		add(ChangeKindRoute, ChangeActionDelete, "ip route del %s", s)
+	}
+
+	rules, err := c.missingRules(conn.Conn)
+	if err != nil {
+		return
+	}
+	for _, rule := range rules {
+		add(ChangeKindRule, ChangeActionAdd, "%s", rule.String())
+	}
+
+	change, err := c.planDNS()
+	if err != nil {
+		return
+	}
+	if change != nil {
+		changes = append(changes, *change)
+	}
+	return
+}
+
+// planDNS is the plan of updateDNS
+func (c *NetworkConfig) planDNS() (change *Change, err error) {
+	backend := DNSBackend
+	if backend == nil {
+		backend, err = NewResolverBackend("auto")
+		if err != nil {
+			return
+		}
+	}
+	statePath := filepath.Join(dnsStateDir, c.Device)
+	oldBackend, oldContent, err := readDNSState(statePath)
+	if err != nil {
+		err = fmt.Errorf("failed to read dns state %s: %w", statePath, err)
+		return
+	}
+	var newContent string
+	if !c.DNS.isEmpty() {
+		newContent = c.DNS.render()
+	}
+	if oldBackend == backend.Name() && oldContent == newContent {
+		return
+	}
+	if newContent == "" {
+		if oldContent == "" {
+			return
+		}
+		change = &Change{
+			Kind:    ChangeKindDNS,
+			Action:  ChangeActionDelete,
+			Command: fmt.Sprintf("unset dns of %s with %s", c.Device, oldBackend),
+		}
+		return
+	}
+	change = &Change{
+		Kind:    ChangeKindDNS,
+		Action:  ChangeActionSet,
+		Command: fmt.Sprintf("set dns of %s with %s: %s", c.Device, backend.Name(), strings.Join(strings.Split(strings.TrimSpace(newContent), "\n"), "; ")),
+	}
+	return
+}
+
+func sortedKeys[T any](m map[string]T) (keys []string) {
+	keys = make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return
+}
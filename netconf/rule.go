@@ -0,0 +1,148 @@
+package netconf
+
+import (
+	"fmt"
+	"github.com/jsimonetti/rtnetlink"
+	"golang.org/x/sys/unix"
+	"log"
+	"net"
+)
+
+func (r *Rule) family() uint8 {
+	for _, prefix := range []*net.IPNet{r.From, r.To} {
+		if prefix == nil {
+			continue
+		}
+		if prefix.IP.To4() != nil {
+			return unix.AF_INET
+		}
+		return unix.AF_INET6
+	}
+	return unix.AF_INET
+}
+
+func (r *Rule) String() string {
+	s := "ip"
+	if r.family() == unix.AF_INET6 {
+		s += " -6"
+	}
+	s += " rule add"
+	if r.From != nil {
+		s += " from " + r.From.String()
+	}
+	if r.To != nil {
+		s += " to " + r.To.String()
+	}
+	if r.FwMark != nil {
+		s += fmt.Sprintf(" fwmark %#x", *r.FwMark)
+	}
+	s += fmt.Sprintf(" table %d", r.Table)
+	if r.Priority != nil {
+		s += fmt.Sprintf(" priority %d", *r.Priority)
+	}
+	return s
+}
+
+func (r *Rule) matches(msg *rtnetlink.RuleMessage) bool {
+	if msg.Family != r.family() || msg.Action != unix.FR_ACT_TO_TBL || msg.Attributes == nil {
+		return false
+	}
+	attrs := msg.Attributes
+	table := uint32(msg.Table)
+	if attrs.Table != nil {
+		table = *attrs.Table
+	}
+	if table != r.Table {
+		return false
+	}
+	prefixMatches := func(prefix *net.IPNet, ip *net.IP, length uint8) bool {
+		if prefix == nil {
+			return length == 0
+		}
+		ones, _ := prefix.Mask.Size()
+		return ip != nil && prefix.IP.Equal(*ip) && int(length) == ones
+	}
+	if !prefixMatches(r.From, attrs.Src, msg.SrcLength) || !prefixMatches(r.To, attrs.Dst, msg.DstLength) {
+		return false
+	}
+	if r.Priority != nil && (attrs.Priority == nil || *attrs.Priority != *r.Priority) {
+		return false
+	}
+	if (r.FwMark == nil) != (attrs.FwMark == nil) {
+		return false
+	}
+	if r.FwMark != nil && *attrs.FwMark != *r.FwMark {
+		return false
+	}
+	return true
+}
+
+func (r *Rule) message() *rtnetlink.RuleMessage {
+	protocol := uint8(unix.RTPROT_STATIC)
+	table := r.Table
+	msg := &rtnetlink.RuleMessage{
+		Family: r.family(),
+		Action: unix.FR_ACT_TO_TBL,
+		Attributes: &rtnetlink.RuleAttributes{
+			Table:    &table,
+			Priority: r.Priority,
+			FwMark:   r.FwMark,
+			Protocol: &protocol,
+		},
+	}
+	if table < 256 {
+		msg.Table = uint8(table)
+	}
+	if r.From != nil {
+		ones, _ := r.From.Mask.Size()
+		msg.SrcLength = uint8(ones)
+		msg.Attributes.Src = &r.From.IP
+	}
+	if r.To != nil {
+		ones, _ := r.To.Mask.Size()
+		msg.DstLength = uint8(ones)
+		msg.Attributes.Dst = &r.To.IP
+	}
+	return msg
+}
+
+// missingRules returns the rules not added yet
+func (c *NetworkConfig) missingRules(conn *rtnetlink.Conn) (rules []Rule, err error) {
+	if len(c.Rules) == 0 {
+		return
+	}
+
+	oldRules, err := conn.Rule.List()
+	if err != nil {
+		err = fmt.Errorf("failed to get old rules: %w", err)
+		return
+	}
+
+newRuleLoopOuter:
+	for _, rule := range c.Rules {
+		for i := range oldRules {
+			if rule.matches(&oldRules[i]) {
+				continue newRuleLoopOuter
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return
+}
+
+func (c *NetworkConfig) updateRules(conn *rtnetlink.Conn) (changed bool, err error) {
+	rules, err := c.missingRules(conn)
+	if err != nil {
+		return
+	}
+	changed = len(rules) > 0
+	for _, rule := range rules {
+		log.Printf("[#] %s", rule.String())
+		err = conn.Rule.Add(rule.message())
+		if err != nil {
+			err = fmt.Errorf("failed to add new rule \"%s\": %w", rule.String(), err)
+			return
+		}
+	}
+	return
+}
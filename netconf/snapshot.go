@@ -0,0 +1,223 @@
+package netconf
+
+import (
+	"fmt"
+	"github.com/jsimonetti/rtnetlink"
+	"github.com/jsimonetti/rtnetlink/rtnl"
+	"golang.org/x/sys/unix"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+// Snapshot is the state of the network which ApplyNetworkConfig may change,
+// taken before applying, so the changes can be rolled back with Restore.
+type Snapshot struct {
+	Device string
+	// Exists is false if the interface is created by the apply, which is
+	// deleted on Restore then
+	Exists    bool
+	MTU       uint32
+	Addresses []net.IPNet
+	// Routes are the routes of the interface in Tables, with the tables set
+	Routes       []Route
+	Tables       []uint32
+	BypassRoutes []BypassRoute
+	// NewRules are the rules to be added by the apply, as the rules are only
+	// added but never removed
+	NewRules   []Rule
+	DNSBackend string
+	DNS        *DNS
+}
+
+// Snapshot takes the state of everything ApplyNetworkConfig may change with
+// this config.
+func (c *NetworkConfig) Snapshot() (snapshot *Snapshot, err error) {
+	conn, err := rtnl.Dial(nil)
+	if err != nil {
+		err = fmt.Errorf("failed to establish netlink conn: %w", err)
+		return
+	}
+	defer conn.Close()
+
+	snapshot = &Snapshot{Device: c.Device}
+	tables := c.routeTables()
+	for table := range tables {
+		snapshot.Tables = append(snapshot.Tables, table)
+	}
+
+	links, err := conn.Conn.Link.List()
+	if err != nil {
+		err = fmt.Errorf("failed to list interfaces: %w", err)
+		return
+	}
+	for _, link := range links {
+		if link.Attributes.Name != c.Device {
+			continue
+		}
+		snapshot.Exists = true
+		snapshot.MTU = link.Attributes.MTU
+
+		var ifce *net.Interface
+		ifce, err = conn.LinkByIndex(int(link.Index))
+		if err != nil {
+			err = fmt.Errorf("failed to get interface %s: %w", c.Device, err)
+			return
+		}
+		var addrs []*net.IPNet
+		addrs, err = conn.Addrs(ifce, unix.AF_UNSPEC)
+		if err != nil {
+			err = fmt.Errorf("failed to get addresses: %w", err)
+			return
+		}
+		for _, addr := range addrs {
+			snapshot.Addresses = append(snapshot.Addresses, *addr)
+		}
+		var routes []rtnetlink.RouteMessage
+		routes, err = listRoute(conn.Conn, ifce)
+		if err != nil {
+			err = fmt.Errorf("failed to get routes: %w", err)
+			return
+		}
+		for i := range routes {
+			route := &routes[i]
+			if route.Protocol != unix.RTPROT_BOOT && route.Protocol != unix.RTPROT_STATIC {
+				continue
+			}
+			table := tableOfRoute(route)
+			if !tables[table] || route.Attributes.OutIface != uint32(ifce.Index) {
+				continue
+			}
+			metric := metricOfRoute(route)
+			snapshot.Routes = append(snapshot.Routes, Route{
+				Destination: prefixOfRoute(route),
+				Table:       &table,
+				Metric:      &metric,
+			})
+		}
+		break
+	}
+
+	snapshot.BypassRoutes, err = readBypassState(filepath.Join(bypassStateDir, c.Device))
+	if err != nil {
+		return
+	}
+	snapshot.NewRules, err = c.missingRules(conn.Conn)
+	if err != nil {
+		return
+	}
+
+	statePath := filepath.Join(dnsStateDir, c.Device)
+	backend, content, err := readDNSState(statePath)
+	if err != nil {
+		err = fmt.Errorf("failed to read dns state %s: %w", statePath, err)
+		return
+	}
+	snapshot.DNSBackend = backend
+	if content != "" {
+		snapshot.DNS = parseDNS(content)
+	}
+	return
+}
+
+// Restore brings the network back to the snapshot, with the inverse of the
+// changes made since then.
+func (s *Snapshot) Restore() (err error) {
+	conn, err := rtnl.Dial(nil)
+	if err != nil {
+		err = fmt.Errorf("failed to establish netlink conn: %w", err)
+		return
+	}
+	defer conn.Close()
+
+	c := &NetworkConfig{
+		Device:       s.Device,
+		MTU:          &s.MTU,
+		Addresses:    s.Addresses,
+		Routes:       s.Routes,
+		BypassRoutes: s.BypassRoutes,
+		DNS:          s.DNS,
+		extraTables:  s.Tables,
+	}
+	if s.DNSBackend != "" {
+		DNSBackend, err = NewResolverBackend(s.DNSBackend)
+		if err != nil {
+			return
+		}
+	}
+
+	// the rules are not bound to the interface, so they are deleted first
+	oldRules, err := conn.Conn.Rule.List()
+	if err != nil {
+		err = fmt.Errorf("failed to get rules: %w", err)
+		return
+	}
+	for _, rule := range s.NewRules {
+		for i := range oldRules {
+			if !rule.matches(&oldRules[i]) {
+				continue
+			}
+			log.Printf("[#] %s", strings.Replace(rule.String(), " rule add", " rule del", 1))
+			err = conn.Conn.Rule.Delete(rule.message())
+			if err != nil {
+				err = fmt.Errorf("failed to delete rule \"%s\": %w", rule.String(), err)
+				return
+			}
+			break
+		}
+	}
+
+	if !s.Exists {
+		var links []rtnetlink.LinkMessage
+		links, err = conn.Conn.Link.List()
+		if err != nil {
+			err = fmt.Errorf("failed to list interfaces: %w", err)
+			return
+		}
+		for _, link := range links {
+			if link.Attributes.Name == s.Device {
+				// deleting the interface removes the addresses and routes with it
+				err = c.RemoveNetworkConfig()
+				return
+			}
+		}
+		// the interface failed to be created, the bypass routes and dns are
+		// brought back to the snapshot
+		_, err = c.updateBypassRoutes(conn.Conn)
+		if err != nil {
+			return
+		}
+		_, err = c.updateDNS()
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	_, err = c.ApplyNetworkConfig()
+	if err != nil {
+		return
+	}
+	return
+}
+
+// parseDNS parses the content of resolv.conf(5) rendered by DNS.render
+func parseDNS(content string) (dns *DNS) {
+	dns = &DNS{}
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			if ip := net.ParseIP(fields[1]); ip != nil {
+				dns.Servers = append(dns.Servers, ip)
+			}
+		case "search":
+			dns.Search = append(dns.Search, fields[1:]...)
+		}
+	}
+	return
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/haruue-net/wg-apply/netconf"
+	"github.com/haruue-net/wg-apply/wgconf"
+	"github.com/haruue-net/wg-apply/wgdiff"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"os"
+	"strings"
+)
+
+var planCmd = &cobra.Command{
+	Use:          "plan [ INTERFACE | CONFIG_FILE ]",
+	Short:        "Print the changes a reload would make, without applying anything",
+	RunE:         Plan,
+	SilenceUsage: true,
+}
+
+type planResult struct {
+	Interface string            `json:"interface"`
+	Action    wgconf.HookAction `json:"action"`
+	WireGuard wgdiff.Plan       `json:"wireguard"`
+	Network   []netconf.Change  `json:"network"`
+	Hooks     []string          `json:"hooks"`
+	Notes     []string          `json:"notes"`
+}
+
+func (r *planResult) isEmpty() bool {
+	return r.WireGuard.IsEmpty() && len(r.Network) == 0
+}
+
+// Plan goes through the same steps as Run until anything is changed, the keys
+// except the public keys are never printed.
+func Plan(cmd *cobra.Command, args []string) (err error) {
+	output := viper.GetString("plan-output")
+	if output != "text" && output != "json" {
+		err = fmt.Errorf("unknown output format %s, available: text, json", output)
+		return
+	}
+
+	wgc, err := wgctrl.New()
+	if err != nil {
+		err = fmt.Errorf("cannot obtains wgctrl client: %w", err)
+		return
+	}
+	defer wgc.Close()
+
+	skipNetwork := viper.GetBool("skip-network")
+
+	conf, err := parseConfig(args)
+	if err != nil {
+		return
+	}
+	if conf.Network == nil {
+		skipNetwork = true
+	}
+
+	result := planResult{
+		Interface: conf.Interface,
+		Action:    wgconf.HookActionReload,
+		Network:   []netconf.Change{},
+		Hooks:     []string{},
+		Notes:     []string{},
+	}
+	for _, w := range conf.Warnings {
+		result.Notes = append(result.Notes, w.Message)
+	}
+
+	current, err := wgc.Device(conf.Interface)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			err = fmt.Errorf("failed to get wireguard interface %s: %w", conf.Interface, err)
+			return
+		}
+		err = nil
+		current = nil
+		result.Action = wgconf.HookActionCreate
+	}
+
+	resolveOpts, err := resolveOptions()
+	if err != nil {
+		return
+	}
+	failed := conf.ResolveEndpoints(context.Background(), resolveOpts)
+	for pubkey, ferr := range failed {
+		result.Notes = append(result.Notes, fmt.Sprintf("peer %s is applied without an endpoint: %v", pubkey, ferr))
+	}
+
+	if !skipNetwork {
+		netconf.DNSBackend, err = netconf.NewResolverBackend(viper.GetString("dns-backend"))
+		if err != nil {
+			return
+		}
+		if network, ok := conf.Network.(*netconf.NetworkConfig); ok {
+			err = checkEndpointLoops(conf, network)
+			if err != nil {
+				return
+			}
+			var changes []netconf.Change
+			changes, err = network.PlanNetworkConfig()
+			if err != nil {
+				err = fmt.Errorf("failed to plan network config changes: %w", err)
+				return
+			}
+			result.Network = append(result.Network, changes...)
+		}
+	}
+
+	if current == nil && skipNetwork {
+		result.Notes = append(result.Notes, fmt.Sprintf("wireguard interface %s is not exist and network changes are skipped, applying would fail", conf.Interface))
+	}
+
+	diffOpts, err := diffOptions(conf.Interface)
+	if err != nil {
+		return
+	}
+	diff, err := wgdiff.CalcDiff(current, &conf.WireGuard, diffOpts)
+	if err != nil {
+		err = fmt.Errorf("failed to calculate diff: %w", err)
+		return
+	}
+	if conf.Save != nil && current != nil {
+		// the peers only in the interface are saved into the config first
+		peers := diff.Peers[:0]
+		for _, peer := range diff.Peers {
+			if !peer.Remove {
+				peers = append(peers, peer)
+			}
+		}
+		diff.Peers = peers
+		result.Notes = append(result.Notes, "SaveConfig is enabled, the runtime state of the interface is merged into the config before applying")
+	}
+	result.WireGuard = wgdiff.Describe(current, diff)
+
+	var hooks []string
+	if runsUpHooks(result.Action) {
+		hooks = append(append(hooks, conf.Hooks.PreUp...), conf.Hooks.PostUp...)
+	}
+	if result.Action == wgconf.HookActionReload && !result.isEmpty() {
+		hooks = append(hooks, conf.Hooks.PostReload...)
+	}
+	for _, hook := range hooks {
+		result.Hooks = append(result.Hooks, strings.ReplaceAll(hook, "%i", conf.Interface))
+	}
+
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(result)
+		return
+	}
+	printPlan(&result)
+	return
+}
+
+func printPlan(r *planResult) {
+	fmt.Printf("%s (%s):", r.Interface, r.Action)
+	if r.isEmpty() {
+		fmt.Print(" no changes")
+	}
+	fmt.Println()
+
+	printFields := func(indent string, fields []wgdiff.FieldChange) {
+		for _, f := range fields {
+			switch {
+			case f.Old == "":
+				fmt.Printf("%s%s: %s\n", indent, f.Field, f.New)
+			case f.New == "":
+				fmt.Printf("%s%s: %s -> (none)\n", indent, f.Field, f.Old)
+			default:
+				fmt.Printf("%s%s: %s -> %s\n", indent, f.Field, f.Old, f.New)
+			}
+		}
+	}
+	if len(r.WireGuard.Interface) > 0 {
+		fmt.Println("  interface:")
+		printFields("    ~ ", r.WireGuard.Interface)
+	}
+	if len(r.WireGuard.Peers) > 0 {
+		fmt.Println("  peers:")
+		for _, peer := range r.WireGuard.Peers {
+			mark := "~"
+			switch peer.Action {
+			case wgdiff.PeerAdd:
+				mark = "+"
+			case wgdiff.PeerRemove:
+				mark = "-"
+			}
+			fmt.Printf("    %s %s\n", mark, peer.PublicKey)
+			printFields("        ", peer.Fields)
+		}
+	}
+	if len(r.Network) > 0 {
+		fmt.Println("  network:")
+		for _, change := range r.Network {
+			fmt.Printf("    %s\n", change.Command)
+		}
+	}
+	if len(r.Hooks) > 0 {
+		fmt.Println("  hooks:")
+		for _, hook := range r.Hooks {
+			fmt.Printf("    %s\n", hook)
+		}
+	}
+	for _, note := range r.Notes {
+		fmt.Printf("  note: %s\n", note)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/haruue-net/wg-apply/netconf"
+	"github.com/haruue-net/wg-apply/wgconf"
+	"github.com/haruue-net/wg-apply/wgdiff"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"log"
+	"os"
+)
+
+// snapshot is the state before applying, to roll back the changes made.
+type snapshot struct {
+	Interface string `json:"interface"`
+	// Device is nil if the wireguard interface does not exist
+	Device *wgtypes.Device `json:"device"`
+	// Network is nil if network changes are skipped
+	Network *netconf.Snapshot `json:"network"`
+	// NetworkApplied and DeviceConfigured are set once the stage is started,
+	// as a failed stage may have changed anything before the failure
+	NetworkApplied   bool `json:"network_applied"`
+	DeviceConfigured bool `json:"device_configured"`
+}
+
+func takeSnapshot(wgc *wgctrl.Client, conf *wgconf.Config, skipNetwork bool) (s *snapshot, err error) {
+	s = &snapshot{Interface: conf.Interface}
+	s.Device, err = wgc.Device(conf.Interface)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			err = fmt.Errorf("failed to get wireguard interface %s: %w", conf.Interface, err)
+			return
+		}
+		err = nil
+		s.Device = nil
+	}
+	if network, ok := conf.Network.(*netconf.NetworkConfig); ok && !skipNetwork {
+		s.Network, err = network.Snapshot()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// changed tells if any stage of the apply has run, so there is anything to
+// restore.
+func (s *snapshot) changed() bool {
+	return (s.NetworkApplied && s.Network != nil) || (s.DeviceConfigured && s.Device != nil)
+}
+
+// restore reverts the wireguard interface and then the network, only the
+// stages which have run. An interface created since the snapshot is deleted.
+func (s *snapshot) restore(wgc *wgctrl.Client) (err error) {
+	if !s.changed() {
+		return
+	}
+	log.Printf("rolling back %s ...", s.Interface)
+	if s.NetworkApplied && s.Network != nil && !s.Network.Exists {
+		err = s.Network.Restore()
+		if err != nil {
+			err = fmt.Errorf("failed to restore network: %w", err)
+		}
+		return
+	}
+
+	var errs []error
+	if s.DeviceConfigured && s.Device != nil {
+		werr := s.restoreDevice(wgc)
+		if werr != nil {
+			errs = append(errs, fmt.Errorf("failed to restore wireguard interface: %w", werr))
+		}
+	}
+	if s.NetworkApplied && s.Network != nil {
+		nerr := s.Network.Restore()
+		if nerr != nil {
+			errs = append(errs, fmt.Errorf("failed to restore network: %w", nerr))
+		}
+	}
+	err = errors.Join(errs...)
+	return
+}
+
+func (s *snapshot) restoreDevice(wgc *wgctrl.Client) (err error) {
+	current, err := wgc.Device(s.Interface)
+	if err != nil {
+		return
+	}
+	config := wgdiff.ConfigOf(s.Device)
+	diff, err := wgdiff.CalcDiff(current, &config, wgdiff.Options{UnsetListenPort: wgdiff.ListenPortKeep})
+	if err != nil {
+		return
+	}
+	if wgdiff.IsEmpty(current, diff) {
+		return
+	}
+	log.Printf("[#] restore wireguard config of %s", s.Interface)
+	err = wgc.ConfigureDevice(s.Interface, *diff)
+	return
+}
@@ -0,0 +1,179 @@
+package uci
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type File []Section
+
+type Section struct {
+	Type    string
+	Name    string
+	Options []Option
+	Line    int
+}
+
+type Option struct {
+	Name   string
+	Values []string
+	IsList bool
+	Line   int
+}
+
+func ParseUCI(reader io.Reader) (file File, err error) {
+	scanner := bufio.NewScanner(reader)
+
+	var currentSection *Section
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+		var tokens []string
+		tokens, err = tokenize(scanner.Text())
+		if err != nil {
+			err = fmt.Errorf("line %d: %w", lineNum, err)
+			return
+		}
+		if len(tokens) == 0 {
+			continue
+		}
+		switch tokens[0] {
+		case "package":
+			if len(tokens) != 2 {
+				err = fmt.Errorf("line %d: invalid package line", lineNum)
+				return
+			}
+			currentSection = nil
+		case "config":
+			if len(tokens) < 2 || len(tokens) > 3 {
+				err = fmt.Errorf("line %d: invalid config line", lineNum)
+				return
+			}
+			section := Section{
+				Type: tokens[1],
+				Line: lineNum,
+			}
+			if len(tokens) == 3 {
+				section.Name = tokens[2]
+			}
+			file = append(file, section)
+			currentSection = &file[len(file)-1]
+		case "option", "list":
+			if currentSection == nil {
+				err = fmt.Errorf("line %d: out of section %s", lineNum, tokens[0])
+				return
+			}
+			if len(tokens) != 3 {
+				err = fmt.Errorf("line %d: invalid %s line", lineNum, tokens[0])
+				return
+			}
+			isList := tokens[0] == "list"
+			if isList {
+				if opt := currentSection.lookupOption(tokens[1]); opt != nil && opt.IsList {
+					opt.Values = append(opt.Values, tokens[2])
+					continue
+				}
+			}
+			currentSection.Options = append(currentSection.Options, Option{
+				Name:   tokens[1],
+				Values: []string{tokens[2]},
+				IsList: isList,
+				Line:   lineNum,
+			})
+		default:
+			err = fmt.Errorf("line %d: unknown keyword %s", lineNum, tokens[0])
+			return
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+func (s *Section) lookupOption(name string) *Option {
+	for i := range s.Options {
+		if s.Options[i].Name == name {
+			return &s.Options[i]
+		}
+	}
+	return nil
+}
+
+// Get returns the last value of the option, or "" if it is not set.
+func (s *Section) Get(name string) (value string) {
+	for _, opt := range s.Options {
+		if opt.Name == name && len(opt.Values) > 0 {
+			value = opt.Values[len(opt.Values)-1]
+		}
+	}
+	return
+}
+
+// GetList returns all values of the option, where the values of an option
+// (rather than a list) are split by whitespaces, as what uci does.
+func (s *Section) GetList(name string) (values []string) {
+	for _, opt := range s.Options {
+		if opt.Name != name {
+			continue
+		}
+		if opt.IsList {
+			values = append(values, opt.Values...)
+		} else {
+			values = append(values, strings.Fields(opt.Values[0])...)
+		}
+	}
+	return
+}
+
+func tokenize(line string) (tokens []string, err error) {
+	var token strings.Builder
+	inToken := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '#' && !inToken:
+			return
+		case c == ' ' || c == '\t' || c == '\r':
+			if inToken {
+				tokens = append(tokens, token.String())
+				token.Reset()
+				inToken = false
+			}
+		case c == '\'':
+			inToken = true
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end == -1 {
+				err = fmt.Errorf("unterminated single quote")
+				return
+			}
+			token.WriteString(line[i+1 : i+1+end])
+			i += end + 1
+		case c == '"':
+			inToken = true
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+				}
+				token.WriteByte(line[i])
+			}
+			if i >= len(line) {
+				err = fmt.Errorf("unterminated double quote")
+				return
+			}
+		case c == '\\' && i+1 < len(line):
+			inToken = true
+			i++
+			token.WriteByte(line[i])
+		default:
+			inToken = true
+			token.WriteByte(c)
+		}
+	}
+	if inToken {
+		tokens = append(tokens, token.String())
+	}
+	return
+}
@@ -0,0 +1,93 @@
+package uci
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	for _, tc := range []struct {
+		line   string
+		tokens []string
+		err    bool
+	}{
+		{"option name wg0", []string{"option", "name", "wg0"}, false},
+		{"\toption name wg0 # comment", []string{"option", "name", "wg0"}, false},
+		{"option name 'wg 0'", []string{"option", "name", "wg 0"}, false},
+		{"option name '#wg0'", []string{"option", "name", "#wg0"}, false},
+		{`option name "a\"b"`, []string{"option", "name", `a"b`}, false},
+		{`option name 'a'"b"c`, []string{"option", "name", "abc"}, false},
+		{`option name a\ b`, []string{"option", "name", "a b"}, false},
+		{"option name ''", []string{"option", "name", ""}, false},
+		{"# comment", nil, false},
+		{"option name 'wg0", nil, true},
+		{`option name "wg0`, nil, true},
+	} {
+		tokens, err := tokenize(tc.line)
+		if tc.err {
+			if err == nil {
+				t.Errorf("tokenize(%q) = %q, want an error", tc.line, tokens)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("tokenize(%q) failed: %v", tc.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(tokens, tc.tokens) {
+			t.Errorf("tokenize(%q) = %q, want %q", tc.line, tokens, tc.tokens)
+		}
+	}
+}
+
+func TestParseUCI(t *testing.T) {
+	file, err := ParseUCI(strings.NewReader(`package network
+
+config interface 'wg0'
+	option proto 'wireguard'
+	list addresses '10.0.0.1/24'
+	option mtu '1420'
+	list addresses 'fd00::1/64'
+	option dns '10.0.0.53 10.0.0.54'
+
+config wireguard_wg0
+	option public_key 'xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg='
+	option endpoint_port '51820'
+	option endpoint_port '51821'
+`))
+	if err != nil {
+		t.Fatalf("ParseUCI failed: %v", err)
+	}
+	if len(file) != 2 {
+		t.Fatalf("ParseUCI returns %d sections, want 2", len(file))
+	}
+	for _, tc := range []struct {
+		section int
+		get     func(s *Section) interface{}
+		want    interface{}
+	}{
+		{0, func(s *Section) interface{} { return s.Type + " " + s.Name }, "interface wg0"},
+		{1, func(s *Section) interface{} { return s.Type + " " + s.Name }, "wireguard_wg0 "},
+		{0, func(s *Section) interface{} { return s.GetList("addresses") }, []string{"10.0.0.1/24", "fd00::1/64"}},
+		{0, func(s *Section) interface{} { return s.GetList("dns") }, []string{"10.0.0.53", "10.0.0.54"}},
+		{0, func(s *Section) interface{} { return s.Get("mtu") }, "1420"},
+		{0, func(s *Section) interface{} { return s.Get("missing") }, ""},
+		{1, func(s *Section) interface{} { return s.Get("endpoint_port") }, "51821"},
+	} {
+		if got := tc.get(&file[tc.section]); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("section %d: got %q, want %q", tc.section, got, tc.want)
+		}
+	}
+
+	for _, input := range []string{
+		"option proto 'wireguard'\n",
+		"config interface wg0 extra\n",
+		"config interface wg0\n\toption proto\n",
+		"config interface wg0\n\tunknown proto wireguard\n",
+	} {
+		if _, err := ParseUCI(strings.NewReader(input)); err == nil {
+			t.Errorf("ParseUCI(%q) succeeded, want an error", input)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/haruue-net/wg-apply/lint"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"os"
+)
+
+var validateCmd = &cobra.Command{
+	Use:          "validate [ INTERFACE | CONFIG_FILE ]",
+	Short:        "Parse the config and report semantic problems, without touching the system",
+	RunE:         Validate,
+	SilenceUsage: true,
+}
+
+var errValidationFailed = errors.New("validation failed")
+
+type validateResult struct {
+	Interface string         `json:"interface,omitempty"`
+	Valid     bool           `json:"valid"`
+	Problems  []lint.Problem `json:"problems"`
+}
+
+// Validate exits non-zero when there is any problem with the error severity,
+// warnings are only reported.
+func Validate(cmd *cobra.Command, args []string) (err error) {
+	output := viper.GetString("validate-output")
+	if output != "text" && output != "json" {
+		err = fmt.Errorf("unknown output format %s, available: text, json", output)
+		return
+	}
+
+	result := validateResult{Problems: []lint.Problem{}}
+	conf, perr := parseConfig(args)
+	if perr != nil {
+		result.Problems = append(result.Problems, lint.Problem{
+			Severity: lint.SeverityError,
+			Code:     "parse-error",
+			Message:  perr.Error(),
+		})
+	} else {
+		result.Interface = conf.Interface
+		result.Problems = append(result.Problems, lint.Check(conf)...)
+	}
+	result.Valid = !lint.HasError(result.Problems)
+
+	switch output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(result)
+		if err != nil {
+			return
+		}
+	default:
+		for _, p := range result.Problems {
+			fmt.Println(p)
+		}
+		if result.Valid {
+			fmt.Printf("%s: ok, %d warning(s)\n", result.Interface, len(result.Problems))
+		}
+	}
+
+	if !result.Valid {
+		err = errValidationFailed
+		return
+	}
+	return
+}
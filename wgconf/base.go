@@ -1,10 +1,16 @@
 package wgconf
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
 )
 
 type parserContextKey string
@@ -12,13 +18,60 @@ type parserContextKey string
 const ctxkParserOptions parserContextKey = "parser-options"
 
 type ParserOptions struct {
-	ProbeParser bool
-	Path        string
-	Interface   string
+	Path      string
+	Interface string
+	// SearchPath is the dirs to look for wg-quick style <interface>.conf, in order
+	SearchPath []string
+	// Source is read instead of the file at Path if set, and Path is then
+	// only used to tell the format. Path defaults to StdinPath with Source.
+	Source io.Reader
+
+	hasSource bool
+	content   []byte
+}
+
+// StdinPath as the Path reads the config from Source, or stdin if Source is
+// not set. The config format can only be told by its content in this case.
+const StdinPath = "-"
+
+var DefaultSearchPath = []string{"/etc/wireguard"}
+
+// Open opens the config file at confPath, the content of Source is returned
+// for the Path in ParserOptions. Parsers should always open config files
+// with it, but not the files referred by the config, such as key files.
+func (po *ParserOptions) Open(confPath string) (f io.ReadCloser, err error) {
+	if po.hasSource && confPath == po.Path {
+		f = io.NopCloser(bytes.NewReader(po.content))
+		return
+	}
+	f, err = os.Open(confPath)
+	return
+}
+
+// ReadFile is the same as Open, but reads the whole file.
+func (po *ParserOptions) ReadFile(confPath string) (content []byte, err error) {
+	if po.hasSource && confPath == po.Path {
+		content = po.content
+		return
+	}
+	content, err = os.ReadFile(confPath)
+	return
+}
+
+// IsStdin tells whether the config is read from Source or stdin, where
+// there is no file path to look at.
+func (po *ParserOptions) IsStdin() bool {
+	return po.Path == StdinPath
 }
 
 var ErrProbeParserMismatch = errors.New("probe parser mismatch")
 
+// ProbeMismatch returns an ErrProbeParserMismatch with the reason why the
+// parser declines.
+func ProbeMismatch(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrProbeParserMismatch, fmt.Sprintf(format, a...))
+}
+
 func ExtractParserOptions(ctx context.Context) (po *ParserOptions) {
 	po, _ = ctx.Value(ctxkParserOptions).(*ParserOptions)
 	return
@@ -26,49 +79,150 @@ func ExtractParserOptions(ctx context.Context) (po *ParserOptions) {
 
 type Parser func(ctx context.Context) (conf *Config, err error)
 
-var parserList = map[string]Parser{}
+// Prober tells whether the config in ParserOptions is in the format of the
+// parser, by looking at the path or sniffing the content, without a full
+// parsing. A mismatch is reported with ProbeMismatch.
+type Prober func(ctx context.Context) (err error)
+
+type ParserRegistration struct {
+	Name string
+	// Priority decides the probing order, lower first
+	Priority    int
+	Description string
+	Probe       Prober
+	Parse       Parser
+}
+
+var parserList []ParserRegistration
 
-func RegisterParser(name string, parser Parser) {
-	if _, ok := parserList[name]; ok {
-		panic("parser already registered: " + name)
+func RegisterParser(reg ParserRegistration) {
+	for _, p := range parserList {
+		if p.Name == reg.Name {
+			panic("parser already registered: " + reg.Name)
+		}
 	}
-	parserList[name] = parser
+	parserList = append(parserList, reg)
+	sort.SliceStable(parserList, func(i, j int) bool {
+		if parserList[i].Priority != parserList[j].Priority {
+			return parserList[i].Priority < parserList[j].Priority
+		}
+		return parserList[i].Name < parserList[j].Name
+	})
+}
+
+// Parsers returns all registered parsers in the probing order.
+func Parsers() []ParserRegistration {
+	return append([]ParserRegistration(nil), parserList...)
 }
 
-func Parse(ctx context.Context, parser string, ifce, path string) (conf *Config, err error) {
-	opts := &ParserOptions{
-		Interface:   ifce,
-		Path:        path,
-		ProbeParser: parser == "",
+func Parse(ctx context.Context, parser string, po ParserOptions) (conf *Config, err error) {
+	opts := &po
+	if len(opts.SearchPath) == 0 {
+		opts.SearchPath = DefaultSearchPath
+	}
+	if opts.Source != nil && opts.Path == "" {
+		opts.Path = StdinPath
+	}
+	if opts.IsStdin() {
+		if opts.Interface == "" {
+			err = errors.New("interface name must be specified when reading config from stdin")
+			return
+		}
+		if opts.Source == nil {
+			opts.Source = os.Stdin
+		}
+	}
+	if opts.Interface == "" && opts.Path == "" {
+		err = errors.New("missing interface name or conf file path")
+		return
+	}
+	if opts.Source != nil {
+		// read only once, as it is shared by the probes of all parsers
+		opts.content, err = io.ReadAll(opts.Source)
+		if err != nil {
+			err = fmt.Errorf("failed to read config: %w", err)
+			return
+		}
+		opts.hasSource = true
 	}
 	ctx = context.WithValue(ctx, ctxkParserOptions, opts)
 
 	if parser != "" {
-		if parser, ok := parserList[parser]; ok {
-			conf, err = parser(ctx)
-			return
+		for _, p := range parserList {
+			if p.Name == parser {
+				conf, err = p.Parse(ctx)
+				return
+			}
 		}
 		err = fmt.Errorf("unknown parser: %s", parser)
 		return
 	}
 
-	for _, parser := range parserList {
-		conf, err = parser(ctx)
+	var reasons []string
+	for _, p := range parserList {
+		perr := p.Probe(ctx)
+		if perr != nil {
+			reasons = append(reasons, fmt.Sprintf("%s: %s", p.Name, strings.TrimPrefix(perr.Error(), ErrProbeParserMismatch.Error()+": ")))
+			continue
+		}
+		conf, err = p.Parse(ctx)
 		if err != nil {
-			if err == ErrProbeParserMismatch {
-				err = nil
-				continue
-			}
-			return
+			err = fmt.Errorf("parser %s: %w", p.Name, err)
 		}
 		return
 	}
-	err = errors.New("cannot detect correct parser, please specify explicitly")
+	err = fmt.Errorf("cannot detect correct parser, please specify explicitly with --parser:\n  %s", strings.Join(reasons, "\n  "))
 	return
 }
 
+// Saver writes the runtime state of the device back to the config, for
+// "SaveConfig = true" of wg-quick, which is done before a reload and on down.
+type Saver func(device *wgtypes.Device) (err error)
+
 type Config struct {
 	Interface string
 	WireGuard wgtypes.Config
 	Network   NetworkConfig
+	Hooks     Hooks
+	// HostEndpoints is the endpoints with a hostname, which are left to be
+	// resolved by ResolveEndpoints
+	HostEndpoints map[wgtypes.Key]string
+	// Save is only set when the config asks for it
+	Save     Saver
+	Warnings []Warning
+}
+
+// Warning is a problem found by the parser, which is not fatal but likely a
+// mistake in the config.
+type Warning struct {
+	Code    string
+	Message string
+}
+
+func (c *Config) AddWarning(code, format string, a ...interface{}) {
+	c.Warnings = append(c.Warnings, Warning{
+		Code:    code,
+		Message: fmt.Sprintf(format, a...),
+	})
+}
+
+// ParseAllowedIP parses a prefix in AllowedIPs, where a single address is
+// accepted as wg(8) does. The host bits are cleared, with a warning as they
+// are likely a typo.
+func (c *Config) ParseAllowedIP(s string) (prefix *net.IPNet, err error) {
+	if !strings.Contains(s, "/") {
+		if strings.Contains(s, ":") {
+			s += "/128"
+		} else {
+			s += "/32"
+		}
+	}
+	ip, prefix, err := net.ParseCIDR(s)
+	if err != nil {
+		return
+	}
+	if !ip.Equal(prefix.IP) {
+		c.AddWarning("allowed-ips-host-bits", "AllowedIPs %s has host bits set, which is treated as %s", s, prefix)
+	}
+	return
 }
@@ -0,0 +1,281 @@
+package wgconf
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ParseEndpoint parses an endpoint in the form of host:port. An IP endpoint
+// is returned as addr, while an endpoint with a hostname is returned as is in
+// hostEndpoint, which is resolved later by ResolveEndpoints, so a hostname
+// failed to resolve never fails the parsing.
+func ParseEndpoint(s string) (addr *net.UDPAddr, hostEndpoint string, err error) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		err = fmt.Errorf("invalid port %s", portStr)
+		return
+	}
+	if host == "" {
+		err = errors.New("missing host")
+		return
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		addr = &net.UDPAddr{IP: ip, Port: int(port)}
+		return
+	}
+	hostEndpoint = s
+	return
+}
+
+// AddHostEndpoint records the endpoint with a hostname of the peer.
+func (c *Config) AddHostEndpoint(peer wgtypes.Key, hostEndpoint string) {
+	if c.HostEndpoints == nil {
+		c.HostEndpoints = map[wgtypes.Key]string{}
+	}
+	c.HostEndpoints[peer] = hostEndpoint
+}
+
+type AddressFamily string
+
+const (
+	FamilyAny        AddressFamily = "any"
+	FamilyPreferIPv4 AddressFamily = "prefer-ipv4"
+	FamilyPreferIPv6 AddressFamily = "prefer-ipv6"
+	FamilyIPv4       AddressFamily = "ipv4"
+	FamilyIPv6       AddressFamily = "ipv6"
+)
+
+const (
+	ResolverSystem = "system"
+	ResolverHosts  = "hosts"
+	// ResolverServerPrefix is followed by the address of a DNS server, such
+	// as "server:1.1.1.1" or "server:[2606:4700:4700::1111]:53"
+	ResolverServerPrefix = "server:"
+)
+
+type ResolveOptions struct {
+	// Retries is the number of retries after the first failure, -1 for
+	// infinity, the same as WG_ENDPOINT_RESOLUTION_RETRIES of wg(8)
+	Retries int
+	// Backoff is the delay before the first retry, which grows linearly up
+	// to 5 times of it
+	Backoff  time.Duration
+	Family   AddressFamily
+	Resolver string
+}
+
+const DefaultResolveRetries = 15
+
+func DefaultResolveOptions() ResolveOptions {
+	return ResolveOptions{
+		Retries:  DefaultResolveRetries,
+		Backoff:  time.Second,
+		Family:   FamilyAny,
+		Resolver: ResolverSystem,
+	}
+}
+
+// ParseRetries parses the number of retries in the format of
+// WG_ENDPOINT_RESOLUTION_RETRIES, where "infinity" means retrying forever.
+func ParseRetries(s string) (retries int, err error) {
+	if s == "infinity" {
+		retries = -1
+		return
+	}
+	retries, err = strconv.Atoi(s)
+	if err != nil || retries < 0 {
+		err = fmt.Errorf("invalid number of retries %s", s)
+		return
+	}
+	return
+}
+
+// ResolveEndpoints resolves HostEndpoints into the peers concurrently. Peers
+// failed to resolve are left without an endpoint, which keeps the current one
+// of the device if any, and are returned in failed.
+func (c *Config) ResolveEndpoints(ctx context.Context, opts ResolveOptions) (failed map[wgtypes.Key]error) {
+	failed = map[wgtypes.Key]error{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := range c.WireGuard.Peers {
+		peer := &c.WireGuard.Peers[i]
+		hostEndpoint, ok := c.HostEndpoints[peer.PublicKey]
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addr, err := ResolveEndpoint(ctx, hostEndpoint, opts)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed[peer.PublicKey] = err
+				return
+			}
+			peer.Endpoint = addr
+		}()
+	}
+	wg.Wait()
+	return
+}
+
+// ResolveEndpoint resolves a host:port endpoint with retries.
+func ResolveEndpoint(ctx context.Context, hostEndpoint string, opts ResolveOptions) (addr *net.UDPAddr, err error) {
+	host, portStr, err := net.SplitHostPort(hostEndpoint)
+	if err != nil {
+		return
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		err = fmt.Errorf("invalid port %s", portStr)
+		return
+	}
+	lookup, err := newLookupFunc(opts.Resolver)
+	if err != nil {
+		return
+	}
+
+	for i := 0; ; i++ {
+		var ips []net.IP
+		ips, err = lookup(ctx, host)
+		if err == nil {
+			var ip net.IP
+			ip, err = pickAddress(ips, opts.Family)
+			if err == nil {
+				addr = &net.UDPAddr{IP: ip, Port: int(port)}
+				return
+			}
+		}
+		if opts.Retries >= 0 && i >= opts.Retries {
+			err = fmt.Errorf("failed to resolve %s after %d tries: %w", host, i+1, err)
+			return
+		}
+		delay := opts.Backoff * time.Duration(i+1)
+		if delay > 5*opts.Backoff {
+			delay = 5 * opts.Backoff
+		}
+		select {
+		case <-ctx.Done():
+			err = fmt.Errorf("failed to resolve %s: %w", host, ctx.Err())
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func pickAddress(ips []net.IP, family AddressFamily) (ip net.IP, err error) {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	var candidates []net.IP
+	switch family {
+	case FamilyAny, "":
+		candidates = ips
+	case FamilyPreferIPv4:
+		candidates = append(v4, v6...)
+	case FamilyPreferIPv6:
+		candidates = append(v6, v4...)
+	case FamilyIPv4:
+		candidates = v4
+	case FamilyIPv6:
+		candidates = v6
+	default:
+		err = fmt.Errorf("unknown address family %s", family)
+		return
+	}
+	if len(candidates) == 0 {
+		err = fmt.Errorf("no %s address found", family)
+		return
+	}
+	ip = candidates[0]
+	return
+}
+
+type lookupFunc func(ctx context.Context, host string) (ips []net.IP, err error)
+
+func newLookupFunc(resolver string) (lookup lookupFunc, err error) {
+	switch {
+	case resolver == ResolverSystem || resolver == "":
+		lookup = func(ctx context.Context, host string) ([]net.IP, error) {
+			return net.DefaultResolver.LookupIP(ctx, "ip", host)
+		}
+	case resolver == ResolverHosts:
+		lookup = lookupHosts
+	case strings.HasPrefix(resolver, ResolverServerPrefix):
+		server := strings.TrimPrefix(resolver, ResolverServerPrefix)
+		if _, _, serr := net.SplitHostPort(server); serr != nil {
+			server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+		}
+		r := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+		lookup = func(ctx context.Context, host string) ([]net.IP, error) {
+			return r.LookupIP(ctx, "ip", host)
+		}
+	default:
+		err = fmt.Errorf("unknown resolver %s, available: %s, %s, %sADDRESS", resolver, ResolverSystem, ResolverHosts, ResolverServerPrefix)
+	}
+	return
+}
+
+// lookupHosts looks up the host in /etc/hosts only
+func lookupHosts(ctx context.Context, host string) (ips []net.IP, err error) {
+	f, err := os.Open("/etc/hosts")
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			if strings.EqualFold(strings.TrimSuffix(name, "."), strings.TrimSuffix(host, ".")) {
+				ips = append(ips, ip)
+				break
+			}
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return
+	}
+	if len(ips) == 0 {
+		err = fmt.Errorf("%s not found in /etc/hosts", host)
+		return
+	}
+	return
+}
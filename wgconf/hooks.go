@@ -0,0 +1,53 @@
+package wgconf
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+type Hooks struct {
+	PreUp    []string
+	PostUp   []string
+	PreDown  []string
+	PostDown []string
+	// PostReload is a wg-apply extension, which runs only when an existing
+	// interface is reloaded with any changes, while PreUp and PostUp only run
+	// when the interface is created
+	PostReload []string
+}
+
+// HookAction is passed to the hooks as $WG_APPLY_ACTION, so hooks can tell
+// whether the interface is created or only reloaded.
+type HookAction string
+
+const (
+	HookActionCreate HookAction = "create"
+	HookActionReload HookAction = "reload"
+	HookActionDown   HookAction = "down"
+)
+
+// RunHooks runs the commands in order with "bash -c" as wg-quick(8) does,
+// where %i is replaced with the interface name. It stops at the first failed
+// command.
+func RunHooks(ifceName string, action HookAction, cmds []string) (err error) {
+	for _, cmd := range cmds {
+		cmd = strings.ReplaceAll(cmd, "%i", ifceName)
+		log.Printf("[#] %s", cmd)
+		c := exec.Command("bash", "-c", cmd)
+		c.Stdout = os.Stdout
+		c.Stderr = os.Stderr
+		c.Env = append(os.Environ(),
+			"WG_APPLY_INTERFACE="+ifceName,
+			"WG_APPLY_ACTION="+string(action),
+		)
+		err = c.Run()
+		if err != nil {
+			err = fmt.Errorf("hook \"%s\" failed: %w", cmd, err)
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,160 @@
+package ifupdown
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/haruue-net/wg-apply/wgconf"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// the same as run-parts(8), which is used by source-directory
+var sourceDirectoryNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+type stanza struct {
+	name    string
+	options []option
+	file    string
+}
+
+type option struct {
+	key   string
+	value string
+	line  int
+}
+
+func parseInterfacesFile(opts *wgconf.ParserOptions, confPath string) (stanzas []*stanza, err error) {
+	stanzas, err = parseSourcedFile(opts, confPath, map[string]bool{})
+	return
+}
+
+func parseSourcedFile(opts *wgconf.ParserOptions, confPath string, visited map[string]bool) (stanzas []*stanza, err error) {
+	absPath, err := filepath.Abs(confPath)
+	if err != nil {
+		err = fmt.Errorf("failed to get absolute path of %s: %w", confPath, err)
+		return
+	}
+	if visited[absPath] {
+		err = fmt.Errorf("%s is sourced more than once", confPath)
+		return
+	}
+	visited[absPath] = true
+
+	f, err := opts.Open(confPath)
+	if err != nil {
+		err = fmt.Errorf("failed to open %s: %w", confPath, err)
+		return
+	}
+	defer f.Close()
+
+	var current *stanza
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		startLine := lineNum
+		for strings.HasSuffix(line, "\\") && scanner.Scan() {
+			lineNum++
+			line = strings.TrimSuffix(line, "\\") + scanner.Text()
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		key := fields[0]
+		value := strings.TrimSpace(strings.TrimPrefix(line, key))
+
+		switch {
+		case key == "iface":
+			if len(fields) < 2 {
+				err = fmt.Errorf("%s:%d: invalid iface stanza: %s", confPath, startLine, line)
+				return
+			}
+			current = &stanza{
+				name: fields[1],
+				file: confPath,
+			}
+			stanzas = append(stanzas, current)
+		case key == "mapping" || key == "auto" || strings.HasPrefix(key, "allow-") ||
+			key == "no-auto-down" || key == "no-scripts" || key == "rename" || key == "template":
+			current = nil
+		case key == "source" || key == "source-directory":
+			current = nil
+			var paths []string
+			paths, err = resolveSource(confPath, key, value)
+			if err != nil {
+				err = fmt.Errorf("%s:%d: %w", confPath, startLine, err)
+				return
+			}
+			for _, p := range paths {
+				var sourced []*stanza
+				sourced, err = parseSourcedFile(opts, p, visited)
+				if err != nil {
+					return
+				}
+				stanzas = append(stanzas, sourced...)
+			}
+		default:
+			if current == nil {
+				// options of mapping stanzas, etc.
+				continue
+			}
+			current.options = append(current.options, option{
+				key:   key,
+				value: value,
+				line:  startLine,
+			})
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		err = fmt.Errorf("failed to read %s: %w", confPath, err)
+		return
+	}
+	return
+}
+
+func resolveSource(confPath, directive, pattern string) (paths []string, err error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(confPath), pattern)
+	}
+	switch directive {
+	case "source":
+		paths, err = filepath.Glob(pattern)
+		if err != nil {
+			err = fmt.Errorf("invalid pattern in \"source %s\": %w", pattern, err)
+			return
+		}
+		sort.Strings(paths)
+		var files []string
+		for _, p := range paths {
+			if fi, serr := os.Stat(p); serr == nil && fi.Mode().IsRegular() {
+				files = append(files, p)
+			}
+		}
+		paths = files
+	case "source-directory":
+		var entries []os.DirEntry
+		entries, err = os.ReadDir(pattern)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				err = nil
+				return
+			}
+			err = fmt.Errorf("failed to read dir in \"source-directory %s\": %w", pattern, err)
+			return
+		}
+		for _, entry := range entries {
+			if entry.Type().IsRegular() && sourceDirectoryNameRegexp.MatchString(entry.Name()) {
+				paths = append(paths, filepath.Join(pattern, entry.Name()))
+			}
+		}
+	}
+	return
+}
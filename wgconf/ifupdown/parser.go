@@ -0,0 +1,336 @@
+package ifupdown
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/haruue-net/wg-apply/netconf"
+	"github.com/haruue-net/wg-apply/wgconf"
+	"github.com/haruue-net/wg-apply/wgconf/wg"
+	"github.com/jsimonetti/rtnetlink/rtnl"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	wgconf.RegisterParser(wgconf.ParserRegistration{
+		Name:        "ifupdown",
+		Priority:    60,
+		Description: "ifupdown wireguard stanzas in " + interfacesPath,
+		Probe:       probe,
+		Parse:       parse,
+	})
+}
+
+const interfacesPath = "/etc/network/interfaces"
+
+func probe(ctx context.Context) (err error) {
+	opts := wgconf.ExtractParserOptions(ctx)
+	if opts == nil {
+		err = errors.New("missing parser options")
+		return
+	}
+	if opts.Path != "" && !opts.IsStdin() {
+		absPath, aerr := filepath.Abs(opts.Path)
+		if aerr != nil {
+			absPath = opts.Path
+		}
+		if absPath != interfacesPath && filepath.Dir(absPath) != interfacesPath+".d" {
+			err = wgconf.ProbeMismatch("%s is neither %s nor in %s.d", opts.Path, interfacesPath, interfacesPath)
+			return
+		}
+	}
+	_, _, _, err = loadStanzas(opts)
+	if err != nil {
+		err = wgconf.ProbeMismatch("%v", err)
+		return
+	}
+	return
+}
+
+// loadStanzas returns all the stanzas of the wireguard interface
+func loadStanzas(opts *wgconf.ParserOptions) (confPath, ifceName string, ifceStanzas []*stanza, err error) {
+	confPath = opts.Path
+	if confPath == "" {
+		confPath = interfacesPath
+	}
+
+	stanzas, err := parseInterfacesFile(opts, confPath)
+	if err != nil {
+		return
+	}
+
+	ifceName = opts.Interface
+	if ifceName == "" {
+		for _, s := range stanzas {
+			if !s.isWireGuard() || s.name == ifceName {
+				continue
+			}
+			if ifceName != "" {
+				err = fmt.Errorf("more than one wireguard interface in %s, please specify the interface name", confPath)
+				return
+			}
+			ifceName = s.name
+		}
+		if ifceName == "" {
+			err = fmt.Errorf("no wireguard interface found in %s", confPath)
+			return
+		}
+	}
+
+	isWireGuard := false
+	for _, s := range stanzas {
+		if s.name == ifceName {
+			ifceStanzas = append(ifceStanzas, s)
+			isWireGuard = isWireGuard || s.isWireGuard()
+		}
+	}
+	if !isWireGuard {
+		err = fmt.Errorf("no wireguard interface %s found in %s", ifceName, confPath)
+		return
+	}
+	return
+}
+
+func parse(ctx context.Context) (conf *wgconf.Config, err error) {
+	opts := wgconf.ExtractParserOptions(ctx)
+	if opts == nil {
+		err = errors.New("missing parser options")
+		return
+	}
+	if opts.Interface == "" && opts.Path == "" {
+		err = errors.New("missing interface name or conf file path")
+		return
+	}
+
+	confPath, ifceName, ifceStanzas, err := loadStanzas(opts)
+	if err != nil {
+		return
+	}
+
+	networkConf := &netconf.NetworkConfig{
+		Device: ifceName,
+	}
+
+	var wgConfPath string
+	for _, s := range ifceStanzas {
+		err = s.parseNetwork(networkConf)
+		if err != nil {
+			return
+		}
+		if p := s.wgConfPath(); p != "" {
+			wgConfPath = p
+		}
+	}
+	if wgConfPath == "" {
+		err = fmt.Errorf("cannot find \"wg setconf %s FILE\" or wireguard-config-path for %s in %s", ifceName, ifceName, confPath)
+		return
+	}
+
+	conf, err = wg.ParseConfFile(wgConfPath)
+	if err != nil {
+		return
+	}
+	conf.Interface = ifceName
+	conf.Network = networkConf
+	return
+}
+
+func (s *stanza) isWireGuard() bool {
+	if s.wgConfPath() != "" {
+		return true
+	}
+	for _, o := range s.options {
+		if o.key == "use" && o.value == "wireguard" {
+			return true
+		}
+		if strings.HasPrefix(o.key, "wireguard-") {
+			return true
+		}
+		if isCommandOption(o.key) {
+			args := s.commandArgs(o.value)
+			// ip link add $IFACE type wireguard
+			if len(args) >= 6 && args[0] == "ip" && args[1] == "link" && args[2] == "add" && args[4] == "type" && args[5] == "wireguard" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *stanza) wgConfPath() (wgConfPath string) {
+	for _, o := range s.options {
+		if o.key == "wireguard-config-path" {
+			wgConfPath = o.value
+			continue
+		}
+		if !isCommandOption(o.key) {
+			continue
+		}
+		args := s.commandArgs(o.value)
+		if len(args) == 4 && args[0] == "wg" && args[1] == "setconf" && args[2] == s.name {
+			wgConfPath = args[3]
+		}
+	}
+	return
+}
+
+func (s *stanza) parseNetwork(networkConf *netconf.NetworkConfig) (err error) {
+	var netmask string
+	for _, o := range s.options {
+		if o.key == "netmask" {
+			netmask = o.value
+		}
+	}
+
+	for _, o := range s.options {
+		switch {
+		case o.key == "address":
+			addrStr := o.value
+			if !strings.Contains(addrStr, "/") && netmask != "" {
+				addrStr, err = withNetmask(addrStr, netmask)
+				if err != nil {
+					err = fmt.Errorf("%s:%d: invalid netmask %s: %w", s.file, o.line, netmask, err)
+					return
+				}
+			}
+			var address *net.IPNet
+			address, err = rtnl.ParseAddr(addrStr)
+			if err != nil {
+				err = fmt.Errorf("%s:%d: failed to parse address %s: %w", s.file, o.line, o.value, err)
+				return
+			}
+			networkConf.Addresses = append(networkConf.Addresses, *address)
+		case o.key == "mtu":
+			var mtu uint64
+			mtu, err = strconv.ParseUint(o.value, 10, 32)
+			if err != nil {
+				err = fmt.Errorf("%s:%d: failed to parse MTU %s: %w", s.file, o.line, o.value, err)
+				return
+			}
+			if mtu > 65535 {
+				err = fmt.Errorf("%s:%d: invalid MTU %d", s.file, o.line, mtu)
+				return
+			}
+			mtu32 := uint32(mtu)
+			networkConf.MTU = &mtu32
+		case isCommandOption(o.key):
+			var route *netconf.Route
+			route, err = s.parseRouteCommand(s.commandArgs(o.value))
+			if err != nil {
+				err = fmt.Errorf("%s:%d: %w", s.file, o.line, err)
+				return
+			}
+			if route != nil {
+				networkConf.Routes = append(networkConf.Routes, *route)
+			}
+		}
+	}
+	return
+}
+
+// parseRouteCommand recognizes "ip route add|replace PREFIX dev IFACE [table T] [metric M]",
+// a nil route is returned for any other command.
+func (s *stanza) parseRouteCommand(args []string) (route *netconf.Route, err error) {
+	if len(args) < 1 || args[0] != "ip" {
+		return
+	}
+	args = args[1:]
+	for len(args) > 0 && (args[0] == "-4" || args[0] == "-6") {
+		args = args[1:]
+	}
+	if len(args) < 3 || (args[0] != "route" && args[0] != "r" && args[0] != "ro") {
+		return
+	}
+	if args[1] != "add" && args[1] != "replace" {
+		return
+	}
+	prefixStr := args[2]
+	if !strings.Contains(prefixStr, "/") {
+		if strings.Contains(prefixStr, ":") {
+			prefixStr += "/128"
+		} else {
+			prefixStr += "/32"
+		}
+	}
+	_, prefix, err := net.ParseCIDR(prefixStr)
+	if err != nil {
+		err = fmt.Errorf("failed to parse route destination %s: %w", args[2], err)
+		return
+	}
+	candidate := &netconf.Route{
+		Destination: *prefix,
+	}
+	onDevice := false
+	rest := args[3:]
+	for i := 0; i+1 < len(rest); i += 2 {
+		switch rest[i] {
+		case "dev":
+			onDevice = rest[i+1] == s.name
+		case "table":
+			var table uint64
+			table, err = strconv.ParseUint(rest[i+1], 0, 32)
+			if err != nil {
+				err = fmt.Errorf("failed to parse route table %s: %w", rest[i+1], err)
+				return
+			}
+			table32 := uint32(table)
+			candidate.Table = &table32
+		case "metric", "priority", "preference":
+			var metric uint64
+			metric, err = strconv.ParseUint(rest[i+1], 0, 32)
+			if err != nil {
+				err = fmt.Errorf("failed to parse route metric %s: %w", rest[i+1], err)
+				return
+			}
+			metric32 := uint32(metric)
+			candidate.Metric = &metric32
+		default:
+			// routes with via, src, etc. are not managed by wg-apply
+			return
+		}
+	}
+	if len(rest)%2 != 0 || !onDevice {
+		return
+	}
+	route = candidate
+	return
+}
+
+func isCommandOption(key string) bool {
+	switch key {
+	case "pre-up", "up", "post-up":
+		return true
+	}
+	return false
+}
+
+func (s *stanza) commandArgs(command string) (args []string) {
+	args = strings.Fields(command)
+	for i := range args {
+		args[i] = strings.ReplaceAll(args[i], "${IFACE}", s.name)
+		args[i] = strings.ReplaceAll(args[i], "$IFACE", s.name)
+	}
+	return
+}
+
+func withNetmask(addr, netmask string) (addrWithPrefix string, err error) {
+	if _, perr := strconv.ParseUint(netmask, 10, 8); perr == nil {
+		addrWithPrefix = addr + "/" + netmask
+		return
+	}
+	maskIP := net.ParseIP(netmask).To4()
+	if maskIP == nil {
+		err = errors.New("not a prefix length or an ipv4 netmask")
+		return
+	}
+	ones, bits := net.IPMask(maskIP).Size()
+	if bits == 0 {
+		err = errors.New("non-contiguous netmask")
+		return
+	}
+	addrWithPrefix = fmt.Sprintf("%s/%d", addr, ones)
+	return
+}
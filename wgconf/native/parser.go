@@ -0,0 +1,436 @@
+package native
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/haruue-net/wg-apply/netconf"
+	"github.com/haruue-net/wg-apply/wgconf"
+	"github.com/jsimonetti/rtnetlink/rtnl"
+	"github.com/pelletier/go-toml/v2"
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gopkg.in/yaml.v3"
+	"net"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func init() {
+	wgconf.RegisterParser(wgconf.ParserRegistration{
+		Name:        "native",
+		Priority:    70,
+		Description: "native YAML, JSON or TOML config in " + confDir,
+		Probe:       probe,
+		Parse:       parse,
+	})
+}
+
+// confDir is not /etc/wg-apply itself, where wg-apply.yaml is the config of
+// wg-apply rather than an interface named wg-apply
+const confDir = "/etc/wg-apply/interfaces"
+
+var confExts = []string{".yaml", ".yml", ".json", ".toml"}
+
+type Config struct {
+	Schema     string   `json:"$schema" yaml:"$schema" toml:"$schema"`
+	Interface  string   `json:"interface" yaml:"interface" toml:"interface"`
+	PrivateKey string   `json:"private_key" yaml:"private_key" toml:"private_key"`
+	ListenPort *int     `json:"listen_port" yaml:"listen_port" toml:"listen_port"`
+	FwMark     *uint32  `json:"fwmark" yaml:"fwmark" toml:"fwmark"`
+	MTU        *uint32  `json:"mtu" yaml:"mtu" toml:"mtu"`
+	Table      *uint32  `json:"table" yaml:"table" toml:"table"`
+	PeerRoutes *bool    `json:"peer_routes" yaml:"peer_routes" toml:"peer_routes"`
+	Addresses  []string `json:"addresses" yaml:"addresses" toml:"addresses"`
+	Routes     []Route  `json:"routes" yaml:"routes" toml:"routes"`
+	Rules      []Rule   `json:"rules" yaml:"rules" toml:"rules"`
+	DNS        *DNS     `json:"dns" yaml:"dns" toml:"dns"`
+	Hooks      *Hooks   `json:"hooks" yaml:"hooks" toml:"hooks"`
+	Peers      []Peer   `json:"peers" yaml:"peers" toml:"peers"`
+}
+
+type Route struct {
+	Destination string  `json:"destination" yaml:"destination" toml:"destination"`
+	Table       *uint32 `json:"table" yaml:"table" toml:"table"`
+	Metric      *uint32 `json:"metric" yaml:"metric" toml:"metric"`
+}
+
+type Rule struct {
+	From     string  `json:"from" yaml:"from" toml:"from"`
+	To       string  `json:"to" yaml:"to" toml:"to"`
+	Table    *uint32 `json:"table" yaml:"table" toml:"table"`
+	Priority *uint32 `json:"priority" yaml:"priority" toml:"priority"`
+	FwMark   *uint32 `json:"fwmark" yaml:"fwmark" toml:"fwmark"`
+}
+
+type DNS struct {
+	Servers []string `json:"servers" yaml:"servers" toml:"servers"`
+	Search  []string `json:"search" yaml:"search" toml:"search"`
+}
+
+type Hooks struct {
+	PreUp      []string `json:"pre_up" yaml:"pre_up" toml:"pre_up"`
+	PostUp     []string `json:"post_up" yaml:"post_up" toml:"post_up"`
+	PreDown    []string `json:"pre_down" yaml:"pre_down" toml:"pre_down"`
+	PostDown   []string `json:"post_down" yaml:"post_down" toml:"post_down"`
+	PostReload []string `json:"post_reload" yaml:"post_reload" toml:"post_reload"`
+}
+
+type Peer struct {
+	Name                string            `json:"name" yaml:"name" toml:"name"`
+	Description         string            `json:"description" yaml:"description" toml:"description"`
+	Metadata            map[string]string `json:"metadata" yaml:"metadata" toml:"metadata"`
+	PublicKey           string            `json:"public_key" yaml:"public_key" toml:"public_key"`
+	PresharedKey        string            `json:"preshared_key" yaml:"preshared_key" toml:"preshared_key"`
+	Endpoint            string            `json:"endpoint" yaml:"endpoint" toml:"endpoint"`
+	AllowedIPs          []string          `json:"allowed_ips" yaml:"allowed_ips" toml:"allowed_ips"`
+	PersistentKeepalive *int              `json:"persistent_keepalive" yaml:"persistent_keepalive" toml:"persistent_keepalive"`
+	RouteTable          *uint32           `json:"route_table" yaml:"route_table" toml:"route_table"`
+	RouteMetric         *uint32           `json:"route_metric" yaml:"route_metric" toml:"route_metric"`
+}
+
+func probe(ctx context.Context) (err error) {
+	opts := wgconf.ExtractParserOptions(ctx)
+	if opts == nil {
+		err = errors.New("missing parser options")
+		return
+	}
+	if opts.Path != "" && !opts.IsStdin() && !isConfExt(path.Ext(opts.Path)) {
+		err = wgconf.ProbeMismatch("%s is not a %s file", opts.Path, strings.Join(confExts, ", "))
+		return
+	}
+	confPath, err := resolveConfPath(opts)
+	if err != nil {
+		err = wgconf.ProbeMismatch("%v", err)
+		return
+	}
+	content, err := opts.ReadFile(confPath)
+	if err != nil {
+		err = wgconf.ProbeMismatch("failed to read conf file %s: %v", confPath, err)
+		return
+	}
+	if confTypeOf(confPath, content) == "" {
+		err = wgconf.ProbeMismatch("%s is not a native conf file", confPath)
+		return
+	}
+	return
+}
+
+func resolveConfPath(opts *wgconf.ParserOptions) (confPath string, err error) {
+	if opts.Path != "" {
+		confPath = opts.Path
+		return
+	}
+	for _, ext := range confExts {
+		p := filepath.Join(confDir, opts.Interface+ext)
+		if unix.Access(p, unix.R_OK) == nil {
+			confPath = p
+			return
+		}
+	}
+	err = fmt.Errorf("no conf file for %s found in %s", opts.Interface, confDir)
+	return
+}
+
+func parse(ctx context.Context) (conf *wgconf.Config, err error) {
+	opts := wgconf.ExtractParserOptions(ctx)
+	if opts == nil {
+		err = errors.New("missing parser options")
+		return
+	}
+	if opts.Interface == "" && opts.Path == "" {
+		err = errors.New("missing interface name or conf file path")
+		return
+	}
+
+	confPath, err := resolveConfPath(opts)
+	if err != nil {
+		return
+	}
+
+	nativeConf, err := decodeConfFile(opts, confPath)
+	if err != nil {
+		return
+	}
+
+	ifceName := opts.Interface
+	if ifceName == "" {
+		ifceName = nativeConf.Interface
+	}
+	if ifceName == "" {
+		ifceName = strings.TrimSuffix(path.Base(confPath), path.Ext(confPath))
+	}
+
+	conf, err = nativeConf.toConfig(ifceName)
+	if err != nil {
+		err = fmt.Errorf("invalid conf file %s: %w", confPath, err)
+		return
+	}
+	return
+}
+
+func isConfExt(ext string) bool {
+	for _, e := range confExts {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeConfFile(opts *wgconf.ParserOptions, confPath string) (nativeConf *Config, err error) {
+	content, err := opts.ReadFile(confPath)
+	if err != nil {
+		err = fmt.Errorf("failed to read conf file %s: %w", confPath, err)
+		return
+	}
+
+	confType := confTypeOf(confPath, content)
+	if confType == "" {
+		if confPath == wgconf.StdinPath {
+			err = errors.New("conf from stdin is neither a yaml, json nor toml native conf")
+			return
+		}
+		// parsed with --parser native, so report the errors of the format
+		confType = strings.TrimPrefix(path.Ext(confPath), ".")
+	}
+	nativeConf = &Config{}
+	err = unmarshalConf(content, confType, nativeConf, true)
+	if err != nil {
+		nativeConf = nil
+		err = fmt.Errorf("conf file %s: %w", confPath, err)
+		return
+	}
+	return
+}
+
+// confTypeOf returns the format of a native conf, or "" if the content is not
+// one: a map with any of the top-level keys interface, private_key and peers.
+// The format of stdin is unknown, yaml also covers json.
+func confTypeOf(confPath string, content []byte) (confType string) {
+	confTypes := []string{strings.TrimPrefix(path.Ext(confPath), ".")}
+	if confPath == wgconf.StdinPath {
+		confTypes = []string{"yaml", "toml"}
+	}
+	for _, t := range confTypes {
+		var m map[string]interface{}
+		if unmarshalConf(content, t, &m, false) != nil {
+			continue
+		}
+		for _, k := range []string{"interface", "private_key", "peers"} {
+			if _, ok := m[k]; ok {
+				confType = t
+				return
+			}
+		}
+	}
+	return
+}
+
+// unmarshalConf decodes with the library of the format directly, keeping the
+// case and the dots of keys, such as the ones in metadata. Unknown fields are
+// refused if strict.
+func unmarshalConf(content []byte, confType string, v interface{}, strict bool) (err error) {
+	switch confType {
+	case "json":
+		dec := json.NewDecoder(bytes.NewReader(content))
+		if strict {
+			dec.DisallowUnknownFields()
+		}
+		err = dec.Decode(v)
+	case "yaml", "yml":
+		dec := yaml.NewDecoder(bytes.NewReader(content))
+		dec.KnownFields(strict)
+		err = dec.Decode(v)
+	case "toml":
+		dec := toml.NewDecoder(bytes.NewReader(content))
+		if strict {
+			dec.DisallowUnknownFields()
+		}
+		err = dec.Decode(v)
+	default:
+		err = fmt.Errorf("unknown conf type %s", confType)
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to decode as %s: %w", confType, err)
+		return
+	}
+	return
+}
+
+func (c *Config) toConfig(ifceName string) (conf *wgconf.Config, err error) {
+	networkConf := &netconf.NetworkConfig{
+		Device: ifceName,
+		MTU:    c.MTU,
+		Table:  c.Table,
+	}
+
+	conf = &wgconf.Config{
+		Interface: ifceName,
+		WireGuard: wgtypes.Config{},
+		Network:   networkConf,
+	}
+
+	if c.PrivateKey != "" {
+		var privkey wgtypes.Key
+		privkey, err = wgtypes.ParseKey(c.PrivateKey)
+		if err != nil {
+			err = fmt.Errorf("failed to parse private_key: %w", err)
+			return
+		}
+		conf.WireGuard.PrivateKey = &privkey
+	}
+	if c.ListenPort != nil {
+		if *c.ListenPort < 0 || *c.ListenPort > 65535 {
+			err = fmt.Errorf("invalid listen_port %d", *c.ListenPort)
+			return
+		}
+		conf.WireGuard.ListenPort = c.ListenPort
+	}
+	if c.FwMark != nil {
+		fwmark := int(*c.FwMark)
+		conf.WireGuard.FirewallMark = &fwmark
+	}
+	if c.MTU != nil && *c.MTU > 65535 {
+		err = fmt.Errorf("invalid mtu %d", *c.MTU)
+		return
+	}
+
+	for _, addrStr := range c.Addresses {
+		var address *net.IPNet
+		address, err = rtnl.ParseAddr(addrStr)
+		if err != nil {
+			err = fmt.Errorf("failed to parse address %s: %w", addrStr, err)
+			return
+		}
+		networkConf.Addresses = append(networkConf.Addresses, *address)
+	}
+
+	for _, route := range c.Routes {
+		var prefix *net.IPNet
+		_, prefix, err = net.ParseCIDR(route.Destination)
+		if err != nil {
+			err = fmt.Errorf("failed to parse route destination %s: %w", route.Destination, err)
+			return
+		}
+		networkConf.Routes = append(networkConf.Routes, netconf.Route{
+			Destination: *prefix,
+			Table:       route.Table,
+			Metric:      route.Metric,
+		})
+	}
+
+	for i, r := range c.Rules {
+		if r.Table == nil {
+			err = fmt.Errorf("missing table of rules[%d]", i)
+			return
+		}
+		rule := netconf.Rule{
+			Table:    *r.Table,
+			Priority: r.Priority,
+			FwMark:   r.FwMark,
+		}
+		if r.From != "" {
+			_, rule.From, err = net.ParseCIDR(r.From)
+			if err != nil {
+				err = fmt.Errorf("failed to parse from %s of rules[%d]: %w", r.From, i, err)
+				return
+			}
+		}
+		if r.To != "" {
+			_, rule.To, err = net.ParseCIDR(r.To)
+			if err != nil {
+				err = fmt.Errorf("failed to parse to %s of rules[%d]: %w", r.To, i, err)
+				return
+			}
+		}
+		networkConf.Rules = append(networkConf.Rules, rule)
+	}
+
+	if c.DNS != nil {
+		networkConf.DNS = &netconf.DNS{Search: c.DNS.Search}
+		for _, server := range c.DNS.Servers {
+			ip := net.ParseIP(server)
+			if ip == nil {
+				err = fmt.Errorf("invalid dns server %s", server)
+				return
+			}
+			networkConf.DNS.Servers = append(networkConf.DNS.Servers, ip)
+		}
+	}
+
+	if c.Hooks != nil {
+		conf.Hooks = wgconf.Hooks{
+			PreUp:      c.Hooks.PreUp,
+			PostUp:     c.Hooks.PostUp,
+			PreDown:    c.Hooks.PreDown,
+			PostDown:   c.Hooks.PostDown,
+			PostReload: c.Hooks.PostReload,
+		}
+	}
+
+	peerRoutes := c.PeerRoutes == nil || *c.PeerRoutes
+
+	for i, p := range c.Peers {
+		peer := wgtypes.PeerConfig{
+			ReplaceAllowedIPs: true,
+		}
+		peer.PublicKey, err = wgtypes.ParseKey(p.PublicKey)
+		if err != nil {
+			err = fmt.Errorf("failed to parse public_key of peers[%d]: %w", i, err)
+			return
+		}
+		if p.PresharedKey != "" {
+			var psk wgtypes.Key
+			psk, err = wgtypes.ParseKey(p.PresharedKey)
+			if err != nil {
+				err = fmt.Errorf("failed to parse preshared_key of peers[%d]: %w", i, err)
+				return
+			}
+			peer.PresharedKey = &psk
+		}
+		if p.Endpoint != "" {
+			var hostEndpoint string
+			peer.Endpoint, hostEndpoint, err = wgconf.ParseEndpoint(p.Endpoint)
+			if err != nil {
+				err = fmt.Errorf("failed to parse endpoint %s of peers[%d]: %w", p.Endpoint, i, err)
+				return
+			}
+			if hostEndpoint != "" {
+				conf.AddHostEndpoint(peer.PublicKey, hostEndpoint)
+			}
+		}
+		for _, prefixStr := range p.AllowedIPs {
+			var prefix *net.IPNet
+			prefix, err = conf.ParseAllowedIP(prefixStr)
+			if err != nil {
+				err = fmt.Errorf("failed to parse allowed_ips %s of peers[%d]: %w", prefixStr, i, err)
+				return
+			}
+			peer.AllowedIPs = append(peer.AllowedIPs, *prefix)
+			if peerRoutes {
+				networkConf.Routes = append(networkConf.Routes, netconf.Route{
+					Destination: *prefix,
+					Table:       p.RouteTable,
+					Metric:      p.RouteMetric,
+				})
+			}
+		}
+		if p.PersistentKeepalive != nil {
+			if *p.PersistentKeepalive < 0 || *p.PersistentKeepalive > 65535 {
+				err = fmt.Errorf("invalid persistent_keepalive %d of peers[%d]", *p.PersistentKeepalive, i)
+				return
+			}
+			keepaliveDuration := time.Duration(*p.PersistentKeepalive) * time.Second
+			peer.PersistentKeepaliveInterval = &keepaliveDuration
+		}
+		conf.WireGuard.Peers = append(conf.WireGuard.Peers, peer)
+	}
+
+	return
+}
@@ -0,0 +1,450 @@
+package netplan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/haruue-net/wg-apply/netconf"
+	"github.com/haruue-net/wg-apply/wgconf"
+	"github.com/jsimonetti/rtnetlink/rtnl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gopkg.in/yaml.v3"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+func init() {
+	wgconf.RegisterParser(wgconf.ParserRegistration{
+		Name:        "netplan",
+		Priority:    40,
+		Description: "netplan tunnels with mode: wireguard in /etc/netplan/*.yaml",
+		Probe:       probe,
+		Parse:       parse,
+	})
+}
+
+// in the order of priority, the same as netplan
+var netplanConfDirs = []string{
+	"/run/netplan",
+	"/etc/netplan",
+	"/lib/netplan",
+}
+
+type netplanConfig struct {
+	Network struct {
+		Tunnels map[string]tunnel `yaml:"tunnels"`
+	} `yaml:"network"`
+}
+
+type tunnel struct {
+	Mode          string        `yaml:"mode"`
+	Key           string        `yaml:"key"`
+	Keys          keys          `yaml:"keys"`
+	Port          *int          `yaml:"port"`
+	Mark          *uint32       `yaml:"mark"`
+	MTU           *uint32       `yaml:"mtu"`
+	Addresses     []interface{} `yaml:"addresses"`
+	Routes        []route       `yaml:"routes"`
+	RoutingPolicy []rule        `yaml:"routing-policy"`
+	Peers         []peer        `yaml:"peers"`
+}
+
+type keys struct {
+	Private string `yaml:"private"`
+	Public  string `yaml:"public"`
+	Shared  string `yaml:"shared"`
+}
+
+type route struct {
+	To     string  `yaml:"to"`
+	Via    string  `yaml:"via"`
+	Table  *uint32 `yaml:"table"`
+	Metric *uint32 `yaml:"metric"`
+}
+
+type rule struct {
+	From     string  `yaml:"from"`
+	To       string  `yaml:"to"`
+	Table    *uint32 `yaml:"table"`
+	Priority *uint32 `yaml:"priority"`
+	Mark     *uint32 `yaml:"mark"`
+}
+
+type peer struct {
+	Keys       keys     `yaml:"keys"`
+	Endpoint   string   `yaml:"endpoint"`
+	AllowedIPs []string `yaml:"allowed-ips"`
+	Keepalive  *int     `yaml:"keepalive"`
+}
+
+func probe(ctx context.Context) (err error) {
+	opts := wgconf.ExtractParserOptions(ctx)
+	if opts == nil {
+		err = errors.New("missing parser options")
+		return
+	}
+	if opts.Path != "" && !opts.IsStdin() {
+		absPath, aerr := filepath.Abs(opts.Path)
+		if aerr != nil {
+			absPath = opts.Path
+		}
+		if !isNetplanConfDir(filepath.Dir(absPath)) {
+			err = wgconf.ProbeMismatch("%s is not in %s", opts.Path, strings.Join(netplanConfDirs, ", "))
+			return
+		}
+		if path.Ext(absPath) != ".yaml" {
+			err = wgconf.ProbeMismatch("%s is not a .yaml file", opts.Path)
+			return
+		}
+	}
+	_, _, err = loadTunnel(opts)
+	if err != nil {
+		err = wgconf.ProbeMismatch("%v", err)
+		return
+	}
+	return
+}
+
+func loadTunnel(opts *wgconf.ParserOptions) (tunnelName string, tun tunnel, err error) {
+	var confPaths []string
+	if opts.Path != "" {
+		confPaths = []string{opts.Path}
+	} else {
+		confPaths, err = listConfFiles()
+		if err != nil {
+			return
+		}
+	}
+
+	merged, err := mergeConfFiles(opts, confPaths)
+	if err != nil {
+		return
+	}
+
+	for name, t := range merged.Network.Tunnels {
+		if t.Mode != "wireguard" {
+			continue
+		}
+		if opts.Interface != "" {
+			if name == opts.Interface {
+				tunnelName, tun = name, t
+			}
+			continue
+		}
+		if tunnelName != "" {
+			err = fmt.Errorf("more than one wireguard tunnel in %s, please specify the interface name", opts.Path)
+			return
+		}
+		tunnelName, tun = name, t
+	}
+	if tunnelName == "" {
+		if opts.Interface != "" {
+			err = fmt.Errorf("no wireguard tunnel %s found in netplan config", opts.Interface)
+		} else {
+			err = fmt.Errorf("no wireguard tunnel found in %s", opts.Path)
+		}
+		return
+	}
+	return
+}
+
+func parse(ctx context.Context) (conf *wgconf.Config, err error) {
+	opts := wgconf.ExtractParserOptions(ctx)
+	if opts == nil {
+		err = errors.New("missing parser options")
+		return
+	}
+	if opts.Interface == "" && opts.Path == "" {
+		err = errors.New("missing interface name or conf file path")
+		return
+	}
+
+	tunnelName, tun, err := loadTunnel(opts)
+	if err != nil {
+		return
+	}
+
+	conf, err = tun.toConfig(tunnelName)
+	if err != nil {
+		err = fmt.Errorf("invalid netplan tunnel %s: %w", tunnelName, err)
+		return
+	}
+	return
+}
+
+func isNetplanConfDir(dir string) bool {
+	for _, d := range netplanConfDirs {
+		if d == dir {
+			return true
+		}
+	}
+	return false
+}
+
+func listConfFiles() (paths []string, err error) {
+	// sorted by file name, a file in a dir with higher priority masks the ones
+	// with the same name in other dirs
+	byName := map[string]string{}
+	for _, dir := range netplanConfDirs {
+		var matches []string
+		matches, err = filepath.Glob(filepath.Join(dir, "*.yaml"))
+		if err != nil {
+			return
+		}
+		for _, match := range matches {
+			name := filepath.Base(match)
+			if _, ok := byName[name]; ok {
+				continue
+			}
+			byName[name] = match
+		}
+	}
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		paths = append(paths, byName[name])
+	}
+	return
+}
+
+// mergeConfFiles merges the files in order as netplan does: mappings are
+// merged recursively, while other values in later files override.
+func mergeConfFiles(opts *wgconf.ParserOptions, confPaths []string) (conf *netplanConfig, err error) {
+	var merged interface{}
+	for _, confPath := range confPaths {
+		var content []byte
+		content, err = opts.ReadFile(confPath)
+		if err != nil {
+			err = fmt.Errorf("failed to read conf file %s: %w", confPath, err)
+			return
+		}
+		var doc interface{}
+		err = yaml.Unmarshal(content, &doc)
+		if err != nil {
+			err = fmt.Errorf("failed to parse conf file %s: %w", confPath, err)
+			return
+		}
+		merged = mergeValue(merged, doc)
+	}
+
+	content, err := yaml.Marshal(merged)
+	if err != nil {
+		err = fmt.Errorf("failed to merge conf files: %w", err)
+		return
+	}
+	conf = &netplanConfig{}
+	err = yaml.Unmarshal(content, conf)
+	if err != nil {
+		err = fmt.Errorf("failed to decode conf files: %w", err)
+		return
+	}
+	return
+}
+
+func mergeValue(old, new interface{}) interface{} {
+	oldMap, ok := old.(map[string]interface{})
+	if !ok {
+		return new
+	}
+	newMap, ok := new.(map[string]interface{})
+	if !ok {
+		return new
+	}
+	for k, v := range newMap {
+		oldMap[k] = mergeValue(oldMap[k], v)
+	}
+	return oldMap
+}
+
+// readKey reads a key which is either base64 or an absolute path to a file
+// containing it, as netplan accepts.
+func readKey(value string) (key wgtypes.Key, err error) {
+	if strings.HasPrefix(value, "/") {
+		var content []byte
+		content, err = os.ReadFile(value)
+		if err != nil {
+			return
+		}
+		value = strings.TrimSpace(string(content))
+	}
+	key, err = wgtypes.ParseKey(value)
+	return
+}
+
+func parsePrefix(prefixStr string, defaultV6 bool) (prefix *net.IPNet, err error) {
+	switch {
+	case prefixStr == "default" && defaultV6:
+		prefixStr = "::/0"
+	case prefixStr == "default":
+		prefixStr = "0.0.0.0/0"
+	case !strings.Contains(prefixStr, "/") && strings.Contains(prefixStr, ":"):
+		prefixStr += "/128"
+	case !strings.Contains(prefixStr, "/"):
+		prefixStr += "/32"
+	}
+	_, prefix, err = net.ParseCIDR(prefixStr)
+	return
+}
+
+func (t *tunnel) toConfig(ifceName string) (conf *wgconf.Config, err error) {
+	networkConf := &netconf.NetworkConfig{
+		Device: ifceName,
+		MTU:    t.MTU,
+	}
+
+	conf = &wgconf.Config{
+		Interface: ifceName,
+		WireGuard: wgtypes.Config{},
+		Network:   networkConf,
+	}
+
+	privkeyStr := t.Keys.Private
+	if privkeyStr == "" {
+		privkeyStr = t.Key
+	}
+	if privkeyStr != "" {
+		var privkey wgtypes.Key
+		privkey, err = readKey(privkeyStr)
+		if err != nil {
+			err = fmt.Errorf("failed to read private key: %w", err)
+			return
+		}
+		conf.WireGuard.PrivateKey = &privkey
+	}
+	if t.Port != nil {
+		if *t.Port < 0 || *t.Port > 65535 {
+			err = fmt.Errorf("invalid port %d", *t.Port)
+			return
+		}
+		conf.WireGuard.ListenPort = t.Port
+	}
+	if t.Mark != nil {
+		fwmark := int(*t.Mark)
+		conf.WireGuard.FirewallMark = &fwmark
+	}
+
+	for _, addr := range t.Addresses {
+		var addrStr string
+		switch a := addr.(type) {
+		case string:
+			addrStr = a
+		case map[string]interface{}:
+			// "10.0.0.1/24": { lifetime: ..., label: ... }
+			for k := range a {
+				addrStr = k
+			}
+		}
+		var address *net.IPNet
+		address, err = rtnl.ParseAddr(addrStr)
+		if err != nil {
+			err = fmt.Errorf("failed to parse address %v: %w", addr, err)
+			return
+		}
+		networkConf.Addresses = append(networkConf.Addresses, *address)
+	}
+
+	for _, r := range t.Routes {
+		if r.Via != "" && !net.ParseIP(r.Via).IsUnspecified() {
+			log.Printf("[warn] route to %s via %s is not supported, ignored", r.To, r.Via)
+			continue
+		}
+		var prefix *net.IPNet
+		prefix, err = parsePrefix(r.To, strings.Contains(r.Via, ":"))
+		if err != nil {
+			err = fmt.Errorf("failed to parse route to %s: %w", r.To, err)
+			return
+		}
+		networkConf.Routes = append(networkConf.Routes, netconf.Route{
+			Destination: *prefix,
+			Table:       r.Table,
+			Metric:      r.Metric,
+		})
+	}
+
+	for _, p := range t.RoutingPolicy {
+		if p.Table == nil {
+			err = fmt.Errorf("missing table in routing-policy from %s to %s", p.From, p.To)
+			return
+		}
+		rule := netconf.Rule{
+			Table:    *p.Table,
+			Priority: p.Priority,
+			FwMark:   p.Mark,
+		}
+		if p.From != "" {
+			rule.From, err = parsePrefix(p.From, false)
+			if err != nil {
+				err = fmt.Errorf("failed to parse routing-policy from %s: %w", p.From, err)
+				return
+			}
+		}
+		if p.To != "" {
+			rule.To, err = parsePrefix(p.To, false)
+			if err != nil {
+				err = fmt.Errorf("failed to parse routing-policy to %s: %w", p.To, err)
+				return
+			}
+		}
+		networkConf.Rules = append(networkConf.Rules, rule)
+	}
+
+	for i, p := range t.Peers {
+		peer := wgtypes.PeerConfig{
+			ReplaceAllowedIPs: true,
+		}
+		peer.PublicKey, err = wgtypes.ParseKey(p.Keys.Public)
+		if err != nil {
+			err = fmt.Errorf("failed to parse public key of peers[%d]: %w", i, err)
+			return
+		}
+		if p.Keys.Shared != "" {
+			var psk wgtypes.Key
+			psk, err = readKey(p.Keys.Shared)
+			if err != nil {
+				err = fmt.Errorf("failed to read shared key of peers[%d]: %w", i, err)
+				return
+			}
+			peer.PresharedKey = &psk
+		}
+		if p.Endpoint != "" {
+			var hostEndpoint string
+			peer.Endpoint, hostEndpoint, err = wgconf.ParseEndpoint(p.Endpoint)
+			if err != nil {
+				err = fmt.Errorf("failed to parse endpoint %s of peers[%d]: %w", p.Endpoint, i, err)
+				return
+			}
+			if hostEndpoint != "" {
+				conf.AddHostEndpoint(peer.PublicKey, hostEndpoint)
+			}
+		}
+		for _, prefixStr := range p.AllowedIPs {
+			var prefix *net.IPNet
+			prefix, err = conf.ParseAllowedIP(prefixStr)
+			if err != nil {
+				err = fmt.Errorf("failed to parse allowed-ips %s of peers[%d]: %w", prefixStr, i, err)
+				return
+			}
+			peer.AllowedIPs = append(peer.AllowedIPs, *prefix)
+		}
+		if p.Keepalive != nil {
+			if *p.Keepalive < 0 || *p.Keepalive > 65535 {
+				err = fmt.Errorf("invalid keepalive %d of peers[%d]", *p.Keepalive, i)
+				return
+			}
+			keepaliveDuration := time.Duration(*p.Keepalive) * time.Second
+			peer.PersistentKeepaliveInterval = &keepaliveDuration
+		}
+		conf.WireGuard.Peers = append(conf.WireGuard.Peers, peer)
+	}
+
+	return
+}
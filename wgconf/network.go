@@ -1,5 +1,8 @@
 package wgconf
 
 type NetworkConfig interface {
-	ApplyNetworkConfig() error
+	// ApplyNetworkConfig tells if anything is changed
+	ApplyNetworkConfig() (changed bool, err error)
+	// RemoveNetworkConfig brings the interface down, which deletes it
+	RemoveNetworkConfig() error
 }
@@ -0,0 +1,686 @@
+package networkd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/haruue-net/wg-apply/ini"
+	"github.com/haruue-net/wg-apply/netconf"
+	"github.com/haruue-net/wg-apply/wgconf"
+	"github.com/jsimonetti/rtnetlink/rtnl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	wgconf.RegisterParser(wgconf.ParserRegistration{
+		Name:        "systemd-networkd",
+		Priority:    20,
+		Description: "systemd.netdev(5) and systemd.network(5) in /etc/systemd/network",
+		Probe:       probe,
+		Parse:       parse,
+	})
+}
+
+// in the order of priority, the same as systemd-networkd
+var networkdConfDirs = []string{
+	"/etc/systemd/network",
+	"/run/systemd/network",
+	"/usr/local/lib/systemd/network",
+	"/usr/lib/systemd/network",
+}
+
+func probe(ctx context.Context) (err error) {
+	opts := wgconf.ExtractParserOptions(ctx)
+	if opts == nil {
+		err = errors.New("missing parser options")
+		return
+	}
+	if opts.Path != "" && !opts.IsStdin() {
+		absPath, aerr := filepath.Abs(opts.Path)
+		if aerr != nil {
+			absPath = opts.Path
+		}
+		if !isNetworkdConfDir(filepath.Dir(absPath)) {
+			err = wgconf.ProbeMismatch("%s is not in %s", opts.Path, strings.Join(networkdConfDirs, ", "))
+			return
+		}
+		if path.Ext(absPath) != ".netdev" {
+			err = wgconf.ProbeMismatch("%s is not a .netdev file", opts.Path)
+			return
+		}
+	}
+	_, _, err = loadNetdev(opts)
+	if err != nil {
+		err = wgconf.ProbeMismatch("%v", err)
+		return
+	}
+	return
+}
+
+func loadNetdev(opts *wgconf.ParserOptions) (netdevPath string, netdevFile ini.File, err error) {
+	if opts.Path != "" {
+		netdevPath = opts.Path
+		netdevFile, err = parseConfFile(opts, netdevPath)
+		if err != nil {
+			return
+		}
+		if kind := lookupValue(netdevFile, "NetDev", "Kind"); kind != "wireguard" {
+			err = fmt.Errorf("netdev %s is not a wireguard netdev (Kind=%s)", netdevPath, kind)
+			return
+		}
+		return
+	}
+	netdevPath, netdevFile, err = findNetdev(opts, opts.Interface)
+	if err != nil {
+		return
+	}
+	if netdevPath == "" {
+		err = fmt.Errorf("no wireguard netdev with Name=%s found in %s", opts.Interface, strings.Join(networkdConfDirs, ", "))
+		return
+	}
+	return
+}
+
+func parse(ctx context.Context) (conf *wgconf.Config, err error) {
+	opts := wgconf.ExtractParserOptions(ctx)
+	if opts == nil {
+		err = errors.New("missing parser options")
+		return
+	}
+	if opts.Interface == "" && opts.Path == "" {
+		err = errors.New("missing interface name or conf file path")
+		return
+	}
+
+	netdevPath, netdevFile, err := loadNetdev(opts)
+	if err != nil {
+		return
+	}
+
+	ifceName := opts.Interface
+	if ifceName == "" {
+		ifceName = lookupValue(netdevFile, "NetDev", "Name")
+		if ifceName == "" {
+			err = fmt.Errorf("missing Name= in [NetDev] section of %s", netdevPath)
+			return
+		}
+	}
+
+	networkConf := &netconf.NetworkConfig{
+		Device: ifceName,
+	}
+
+	conf = &wgconf.Config{
+		Interface: ifceName,
+		WireGuard: wgtypes.Config{},
+		Network:   networkConf,
+	}
+
+	err = parseNetdev(netdevPath, netdevFile, conf, networkConf)
+	if err != nil {
+		return
+	}
+
+	networkPath, networkFile, err := findNetwork(opts, ifceName)
+	if err != nil {
+		return
+	}
+	if networkPath == "" {
+		log.Printf("[warn] no .network file matches interface %s, only the netdev %s is applied", ifceName, netdevPath)
+		return
+	}
+	err = parseNetwork(networkPath, networkFile, networkConf)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func parseNetdev(netdevPath string, netdevFile ini.File, conf *wgconf.Config, networkConf *netconf.NetworkConfig) (err error) {
+	var routeTable *uint32
+	var routeMetric *uint32
+
+	type peerRouteConfig struct {
+		table    *uint32
+		tableSet bool
+		metric   *uint32
+	}
+	var peerRoutes []peerRouteConfig
+
+	for _, section := range netdevFile {
+		switch section.Name {
+		case "NetDev":
+			for _, pair := range section.Pairs {
+				switch pair.Key {
+				case "MTUBytes":
+					var mtu uint32
+					mtu, err = parseBytes(pair.Value)
+					if err != nil {
+						err = fmt.Errorf("failed to parse MTU in \"MTUBytes=%s\" of %s: %w", pair.Value, netdevPath, err)
+						return
+					}
+					networkConf.MTU = &mtu
+				}
+			}
+		case "WireGuard":
+			for _, pair := range section.Pairs {
+				switch pair.Key {
+				case "PrivateKey":
+					var privkey wgtypes.Key
+					privkey, err = wgtypes.ParseKey(pair.Value)
+					if err != nil {
+						err = fmt.Errorf("failed to parse private key in \"PrivateKey=\" of %s: %w", netdevPath, err)
+						return
+					}
+					conf.WireGuard.PrivateKey = &privkey
+				case "PrivateKeyFile":
+					var privkey wgtypes.Key
+					privkey, err = readKeyFile(pair.Value)
+					if err != nil {
+						err = fmt.Errorf("failed to read private key in \"PrivateKeyFile=%s\" of %s: %w", pair.Value, netdevPath, err)
+						return
+					}
+					conf.WireGuard.PrivateKey = &privkey
+				case "ListenPort":
+					if pair.Value == "auto" || pair.Value == "" {
+						conf.WireGuard.ListenPort = nil
+						continue
+					}
+					var port int
+					port, err = strconv.Atoi(pair.Value)
+					if err != nil {
+						err = fmt.Errorf("failed to parse listen port in \"ListenPort=%s\" of %s: %w", pair.Value, netdevPath, err)
+						return
+					}
+					if port < 0 || port > 65535 {
+						err = fmt.Errorf("invalid listen port %d", port)
+						return
+					}
+					conf.WireGuard.ListenPort = &port
+				case "FirewallMark":
+					var fwmark64 uint64
+					fwmark64, err = strconv.ParseUint(pair.Value, 0, 32)
+					if err != nil {
+						err = fmt.Errorf("failed to parse fwmark in \"FirewallMark=%s\" of %s: %w", pair.Value, netdevPath, err)
+						return
+					}
+					fwmark := int(uint32(fwmark64))
+					conf.WireGuard.FirewallMark = &fwmark
+				case "RouteTable":
+					routeTable, err = parseRouteTable(pair.Value)
+					if err != nil {
+						err = fmt.Errorf("failed to parse route table in \"RouteTable=%s\" of %s: %w", pair.Value, netdevPath, err)
+						return
+					}
+				case "RouteMetric":
+					routeMetric, err = parseRouteMetric(pair.Value)
+					if err != nil {
+						err = fmt.Errorf("failed to parse route metric in \"RouteMetric=%s\" of %s: %w", pair.Value, netdevPath, err)
+						return
+					}
+				default:
+					log.Printf("[warn] unknown key in [WireGuard] section of %s: %s=%s, ignored", netdevPath, pair.Key, pair.Value)
+				}
+			}
+		case "WireGuardPeer":
+			peer := wgtypes.PeerConfig{
+				ReplaceAllowedIPs: true,
+			}
+			var peerRoute peerRouteConfig
+			var hostEndpoint string
+			for _, pair := range section.Pairs {
+				switch pair.Key {
+				case "PublicKey":
+					var pubkey wgtypes.Key
+					pubkey, err = wgtypes.ParseKey(pair.Value)
+					if err != nil {
+						err = fmt.Errorf("failed to parse public key in \"PublicKey=%s\" of %s: %w", pair.Value, netdevPath, err)
+						return
+					}
+					peer.PublicKey = pubkey
+				case "PresharedKey":
+					var psk wgtypes.Key
+					psk, err = wgtypes.ParseKey(pair.Value)
+					if err != nil {
+						err = fmt.Errorf("failed to parse preshared key in \"PresharedKey=\" of %s: %w", netdevPath, err)
+						return
+					}
+					peer.PresharedKey = &psk
+				case "PresharedKeyFile":
+					var psk wgtypes.Key
+					psk, err = readKeyFile(pair.Value)
+					if err != nil {
+						err = fmt.Errorf("failed to read preshared key in \"PresharedKeyFile=%s\" of %s: %w", pair.Value, netdevPath, err)
+						return
+					}
+					peer.PresharedKey = &psk
+				case "AllowedIPs":
+					if pair.Value == "" {
+						// an empty assignment resets the list
+						peer.AllowedIPs = nil
+						continue
+					}
+					prefixes := strings.Split(pair.Value, ",")
+					for _, prefixStr := range prefixes {
+						prefixStr = strings.TrimSpace(prefixStr)
+						if prefixStr == "" {
+							continue
+						}
+						var prefix *net.IPNet
+						prefix, err = conf.ParseAllowedIP(prefixStr)
+						if err != nil {
+							err = fmt.Errorf("failed to parse prefix %s in \"AllowedIPs=%s\" of %s: %w", prefixStr, pair.Value, netdevPath, err)
+							return
+						}
+						peer.AllowedIPs = append(peer.AllowedIPs, *prefix)
+					}
+				case "Endpoint":
+					peer.Endpoint, hostEndpoint, err = wgconf.ParseEndpoint(pair.Value)
+					if err != nil {
+						err = fmt.Errorf("failed to parse endpoint in \"Endpoint=%s\" of %s: %w", pair.Value, netdevPath, err)
+						return
+					}
+				case "PersistentKeepalive":
+					if pair.Value == "off" {
+						peer.PersistentKeepaliveInterval = nil
+						continue
+					}
+					var keepalive int
+					keepalive, err = strconv.Atoi(pair.Value)
+					if err != nil {
+						err = fmt.Errorf("failed to parse persistent keepalive in \"PersistentKeepalive=%s\" of %s: %w", pair.Value, netdevPath, err)
+						return
+					}
+					if keepalive < 0 || keepalive > 65535 {
+						err = fmt.Errorf("invalid persistent keepalive %d", keepalive)
+						return
+					}
+					keepaliveDuration := time.Duration(keepalive) * time.Second
+					peer.PersistentKeepaliveInterval = &keepaliveDuration
+				case "RouteTable":
+					peerRoute.table, err = parseRouteTable(pair.Value)
+					if err != nil {
+						err = fmt.Errorf("failed to parse route table in \"RouteTable=%s\" of %s: %w", pair.Value, netdevPath, err)
+						return
+					}
+					peerRoute.tableSet = true
+				case "RouteMetric":
+					peerRoute.metric, err = parseRouteMetric(pair.Value)
+					if err != nil {
+						err = fmt.Errorf("failed to parse route metric in \"RouteMetric=%s\" of %s: %w", pair.Value, netdevPath, err)
+						return
+					}
+				default:
+					log.Printf("[warn] unknown key in [WireGuardPeer] section of %s: %s=%s, ignored", netdevPath, pair.Key, pair.Value)
+				}
+			}
+			conf.WireGuard.Peers = append(conf.WireGuard.Peers, peer)
+			if hostEndpoint != "" {
+				conf.AddHostEndpoint(peer.PublicKey, hostEndpoint)
+			}
+			peerRoutes = append(peerRoutes, peerRoute)
+		}
+	}
+
+	// RouteTable= and RouteMetric= in [WireGuardPeer] fall back to the ones in [WireGuard]
+	for i, peer := range conf.WireGuard.Peers {
+		table := routeTable
+		if peerRoutes[i].tableSet {
+			table = peerRoutes[i].table
+		}
+		if table == nil {
+			// RouteTable=off
+			continue
+		}
+		metric := routeMetric
+		if peerRoutes[i].metric != nil {
+			metric = peerRoutes[i].metric
+		}
+		for _, prefix := range peer.AllowedIPs {
+			networkConf.Routes = append(networkConf.Routes, netconf.Route{
+				Destination: prefix,
+				Table:       table,
+				Metric:      metric,
+			})
+		}
+	}
+
+	return
+}
+
+func parseNetwork(networkPath string, networkFile ini.File, networkConf *netconf.NetworkConfig) (err error) {
+	parseAddress := func(value string) (err error) {
+		address, err := rtnl.ParseAddr(value)
+		if err != nil {
+			err = fmt.Errorf("failed to parse address in \"Address=%s\" of %s: %w", value, networkPath, err)
+			return
+		}
+		networkConf.Addresses = append(networkConf.Addresses, *address)
+		return
+	}
+
+	for _, section := range networkFile {
+		switch section.Name {
+		case "Link":
+			for _, pair := range section.Pairs {
+				switch pair.Key {
+				case "MTUBytes":
+					var mtu uint32
+					mtu, err = parseBytes(pair.Value)
+					if err != nil {
+						err = fmt.Errorf("failed to parse MTU in \"MTUBytes=%s\" of %s: %w", pair.Value, networkPath, err)
+						return
+					}
+					networkConf.MTU = &mtu
+				}
+			}
+		case "Network":
+			for _, pair := range section.Pairs {
+				switch pair.Key {
+				case "Address":
+					err = parseAddress(pair.Value)
+					if err != nil {
+						return
+					}
+				}
+			}
+		case "Address":
+			for _, pair := range section.Pairs {
+				switch pair.Key {
+				case "Address":
+					err = parseAddress(pair.Value)
+					if err != nil {
+						return
+					}
+				}
+			}
+		case "Route":
+			var route netconf.Route
+			hasDestination := false
+			hasGateway := false
+			for _, pair := range section.Pairs {
+				switch pair.Key {
+				case "Destination":
+					var prefix *net.IPNet
+					value := pair.Value
+					if !strings.Contains(value, "/") {
+						// a single address
+						if strings.Contains(value, ":") {
+							value += "/128"
+						} else {
+							value += "/32"
+						}
+					}
+					_, prefix, err = net.ParseCIDR(value)
+					if err != nil {
+						err = fmt.Errorf("failed to parse destination in \"Destination=%s\" of %s: %w", pair.Value, networkPath, err)
+						return
+					}
+					route.Destination = *prefix
+					hasDestination = true
+				case "Table":
+					route.Table, err = parseRouteTable(pair.Value)
+					if err != nil {
+						err = fmt.Errorf("failed to parse route table in \"Table=%s\" of %s: %w", pair.Value, networkPath, err)
+						return
+					}
+				case "Metric":
+					route.Metric, err = parseRouteMetric(pair.Value)
+					if err != nil {
+						err = fmt.Errorf("failed to parse route metric in \"Metric=%s\" of %s: %w", pair.Value, networkPath, err)
+						return
+					}
+				case "Gateway":
+					hasGateway = true
+				}
+			}
+			if hasGateway {
+				log.Printf("[warn] [Route] with Gateway= in %s is not supported, ignored", networkPath)
+				continue
+			}
+			if !hasDestination {
+				log.Printf("[warn] [Route] without Destination= in %s is not supported, ignored", networkPath)
+				continue
+			}
+			networkConf.Routes = append(networkConf.Routes, route)
+		}
+	}
+	return
+}
+
+func isNetworkdConfDir(dir string) bool {
+	for _, d := range networkdConfDirs {
+		if d == dir {
+			return true
+		}
+	}
+	return false
+}
+
+func listConfFiles(ext string) (paths []string, err error) {
+	// sorted by file name, a file in a dir with higher priority masks the ones
+	// with the same name in other dirs
+	byName := map[string]string{}
+	for _, dir := range networkdConfDirs {
+		var entries []os.DirEntry
+		entries, err = os.ReadDir(dir)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				err = nil
+				continue
+			}
+			err = fmt.Errorf("failed to read dir %s: %w", dir, err)
+			return
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if path.Ext(name) != ext {
+				continue
+			}
+			if _, ok := byName[name]; ok {
+				continue
+			}
+			byName[name] = filepath.Join(dir, name)
+		}
+	}
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		paths = append(paths, byName[name])
+	}
+	return
+}
+
+func findNetdev(opts *wgconf.ParserOptions, ifceName string) (netdevPath string, netdevFile ini.File, err error) {
+	paths, err := listConfFiles(".netdev")
+	if err != nil {
+		return
+	}
+	for _, p := range paths {
+		var f ini.File
+		f, err = parseConfFile(opts, p)
+		if err != nil {
+			return
+		}
+		if lookupValue(f, "NetDev", "Kind") != "wireguard" {
+			continue
+		}
+		if lookupValue(f, "NetDev", "Name") != ifceName {
+			continue
+		}
+		netdevPath = p
+		netdevFile = f
+		return
+	}
+	return
+}
+
+func findNetwork(opts *wgconf.ParserOptions, ifceName string) (networkPath string, networkFile ini.File, err error) {
+	paths, err := listConfFiles(".network")
+	if err != nil {
+		return
+	}
+	for _, p := range paths {
+		var f ini.File
+		f, err = parseConfFile(opts, p)
+		if err != nil {
+			return
+		}
+		if !matchName(f, ifceName) {
+			continue
+		}
+		networkPath = p
+		networkFile = f
+		return
+	}
+	return
+}
+
+func matchName(f ini.File, ifceName string) bool {
+	var patterns []string
+	for _, section := range f {
+		if section.Name != "Match" {
+			continue
+		}
+		for _, pair := range section.Pairs {
+			if pair.Key != "Name" {
+				continue
+			}
+			if pair.Value == "" {
+				patterns = nil
+				continue
+			}
+			patterns = append(patterns, strings.Fields(pair.Value)...)
+		}
+	}
+	if len(patterns) == 0 {
+		return false
+	}
+	invert := false
+	if strings.HasPrefix(patterns[0], "!") {
+		invert = true
+		patterns[0] = strings.TrimPrefix(patterns[0], "!")
+	}
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, ifceName); matched {
+			return !invert
+		}
+	}
+	return invert
+}
+
+func parseConfFile(opts *wgconf.ParserOptions, confPath string) (file ini.File, err error) {
+	confFile, err := opts.Open(confPath)
+	if err != nil {
+		err = fmt.Errorf("failed to open conf file %s: %w", confPath, err)
+		return
+	}
+	defer confFile.Close()
+
+	file, err = ini.ParseINI(confFile)
+	if err != nil {
+		err = fmt.Errorf("failed to parse conf file %s: %w", confPath, err)
+		return
+	}
+	return
+}
+
+func lookupValue(f ini.File, sectionName, key string) (value string) {
+	for _, section := range f {
+		if section.Name != sectionName {
+			continue
+		}
+		for _, pair := range section.Pairs {
+			if pair.Key == key {
+				// the last assignment wins
+				value = pair.Value
+			}
+		}
+	}
+	return
+}
+
+func readKeyFile(keyPath string) (key wgtypes.Key, err error) {
+	content, err := os.ReadFile(keyPath)
+	if err != nil {
+		return
+	}
+	key, err = wgtypes.ParseKey(strings.TrimSpace(string(content)))
+	return
+}
+
+func parseRouteTable(value string) (table *uint32, err error) {
+	var table32 uint32
+	switch value {
+	case "off", "no", "false":
+		return
+	case "default":
+		table32 = 253
+	case "main":
+		table32 = 254
+	case "local":
+		table32 = 255
+	default:
+		var table64 uint64
+		table64, err = strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return
+		}
+		if table64 == 0 {
+			err = errors.New("table number must be in the range 1…4294967295")
+			return
+		}
+		table32 = uint32(table64)
+	}
+	table = &table32
+	return
+}
+
+func parseRouteMetric(value string) (metric *uint32, err error) {
+	metric64, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return
+	}
+	metric32 := uint32(metric64)
+	metric = &metric32
+	return
+}
+
+func parseBytes(value string) (bytes uint32, err error) {
+	multiplier := uint64(1)
+	switch {
+	case strings.HasSuffix(value, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(value, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+	bytes64, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return
+	}
+	bytes64 *= multiplier
+	if bytes64 > 65535 {
+		err = fmt.Errorf("invalid MTU %d", bytes64)
+		return
+	}
+	bytes = uint32(bytes64)
+	return
+}
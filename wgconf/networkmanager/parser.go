@@ -0,0 +1,478 @@
+package networkmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/haruue-net/wg-apply/ini"
+	"github.com/haruue-net/wg-apply/netconf"
+	"github.com/haruue-net/wg-apply/wgconf"
+	"github.com/jsimonetti/rtnetlink/rtnl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	wgconf.RegisterParser(wgconf.ParserRegistration{
+		Name:        "networkmanager",
+		Priority:    30,
+		Description: "NetworkManager keyfiles with type=wireguard in " + systemConnectionsDir,
+		Probe:       probe,
+		Parse:       parse,
+	})
+}
+
+const systemConnectionsDir = "/etc/NetworkManager/system-connections"
+
+const peerSectionPrefix = "wireguard-peer."
+
+func probe(ctx context.Context) (err error) {
+	opts := wgconf.ExtractParserOptions(ctx)
+	if opts == nil {
+		err = errors.New("missing parser options")
+		return
+	}
+	_, _, err = loadConnection(opts)
+	if err != nil {
+		err = wgconf.ProbeMismatch("%v", err)
+		return
+	}
+	return
+}
+
+func loadConnection(opts *wgconf.ParserOptions) (confPath string, keyFile ini.File, err error) {
+	if opts.Path != "" {
+		confPath = opts.Path
+		keyFile, err = parseKeyFile(opts, confPath)
+		if err != nil {
+			return
+		}
+		if connType := lookupValue(keyFile, "connection", "type"); connType != "wireguard" {
+			err = fmt.Errorf("connection %s is not a wireguard connection (type=%s)", confPath, connType)
+			return
+		}
+		return
+	}
+	confPath, keyFile, err = findConnection(opts, opts.Interface)
+	if err != nil {
+		return
+	}
+	if confPath == "" {
+		err = fmt.Errorf("no wireguard connection with interface-name=%s found in %s", opts.Interface, systemConnectionsDir)
+		return
+	}
+	return
+}
+
+func parse(ctx context.Context) (conf *wgconf.Config, err error) {
+	opts := wgconf.ExtractParserOptions(ctx)
+	if opts == nil {
+		err = errors.New("missing parser options")
+		return
+	}
+	if opts.Interface == "" && opts.Path == "" {
+		err = errors.New("missing interface name or conf file path")
+		return
+	}
+
+	confPath, keyFile, err := loadConnection(opts)
+	if err != nil {
+		return
+	}
+
+	ifceName := opts.Interface
+	if ifceName == "" {
+		ifceName = lookupValue(keyFile, "connection", "interface-name")
+		if ifceName == "" {
+			err = fmt.Errorf("missing interface-name in [connection] section of %s", confPath)
+			return
+		}
+	}
+
+	networkConf := &netconf.NetworkConfig{
+		Device: ifceName,
+	}
+
+	conf = &wgconf.Config{
+		Interface: ifceName,
+		WireGuard: wgtypes.Config{},
+		Network:   networkConf,
+	}
+
+	peerRoutes := true
+	var routeTables [2]*uint32
+	var routeMetrics [2]*uint32
+
+	for _, section := range keyFile {
+		switch {
+		case section.Name == "wireguard":
+			for _, pair := range section.Pairs {
+				switch pair.Key {
+				case "private-key":
+					var privkey wgtypes.Key
+					privkey, err = wgtypes.ParseKey(pair.Value)
+					if err != nil {
+						err = fmt.Errorf("failed to parse private key in \"private-key=\" of %s: %w", confPath, err)
+						return
+					}
+					conf.WireGuard.PrivateKey = &privkey
+				case "private-key-flags":
+					if pair.Value != "0" {
+						err = fmt.Errorf("private key owned by a secret agent (private-key-flags=%s) is not supported", pair.Value)
+						return
+					}
+				case "listen-port":
+					var port int
+					port, err = strconv.Atoi(pair.Value)
+					if err != nil {
+						err = fmt.Errorf("failed to parse listen port in \"listen-port=%s\" of %s: %w", pair.Value, confPath, err)
+						return
+					}
+					if port < 0 || port > 65535 {
+						err = fmt.Errorf("invalid listen port %d", port)
+						return
+					}
+					if port == 0 {
+						// random port
+						continue
+					}
+					conf.WireGuard.ListenPort = &port
+				case "fwmark":
+					var fwmark64 uint64
+					fwmark64, err = strconv.ParseUint(pair.Value, 0, 32)
+					if err != nil {
+						err = fmt.Errorf("failed to parse fwmark in \"fwmark=%s\" of %s: %w", pair.Value, confPath, err)
+						return
+					}
+					fwmark := int(uint32(fwmark64))
+					conf.WireGuard.FirewallMark = &fwmark
+				case "mtu":
+					var mtu uint64
+					mtu, err = strconv.ParseUint(pair.Value, 10, 32)
+					if err != nil {
+						err = fmt.Errorf("failed to parse MTU in \"mtu=%s\" of %s: %w", pair.Value, confPath, err)
+						return
+					}
+					if mtu > 65535 {
+						err = fmt.Errorf("invalid MTU %d", mtu)
+						return
+					}
+					if mtu == 0 {
+						// automatic
+						continue
+					}
+					mtu32 := uint32(mtu)
+					networkConf.MTU = &mtu32
+				case "peer-routes":
+					peerRoutes, err = strconv.ParseBool(pair.Value)
+					if err != nil {
+						err = fmt.Errorf("failed to parse \"peer-routes=%s\" of %s: %w", pair.Value, confPath, err)
+						return
+					}
+				case "ip4-auto-default-route", "ip6-auto-default-route":
+					// policy routing for the default route is not supported
+				default:
+					log.Printf("[warn] unknown key in [wireguard] section of %s: %s=%s, ignored", confPath, pair.Key, pair.Value)
+				}
+			}
+		case strings.HasPrefix(section.Name, peerSectionPrefix):
+			peer := wgtypes.PeerConfig{
+				ReplaceAllowedIPs: true,
+			}
+			pubkeyStr := strings.TrimPrefix(section.Name, peerSectionPrefix)
+			peer.PublicKey, err = wgtypes.ParseKey(pubkeyStr)
+			if err != nil {
+				err = fmt.Errorf("failed to parse public key in section [%s] of %s: %w", section.Name, confPath, err)
+				return
+			}
+			for _, pair := range section.Pairs {
+				switch pair.Key {
+				case "preshared-key":
+					var psk wgtypes.Key
+					psk, err = wgtypes.ParseKey(pair.Value)
+					if err != nil {
+						err = fmt.Errorf("failed to parse preshared key in \"preshared-key=\" of %s: %w", confPath, err)
+						return
+					}
+					peer.PresharedKey = &psk
+				case "preshared-key-flags":
+					if pair.Value != "0" {
+						err = fmt.Errorf("preshared key owned by a secret agent (preshared-key-flags=%s) is not supported", pair.Value)
+						return
+					}
+				case "allowed-ips":
+					prefixes := strings.Split(pair.Value, ";")
+					for _, prefixStr := range prefixes {
+						prefixStr = strings.TrimSpace(prefixStr)
+						if prefixStr == "" {
+							continue
+						}
+						var prefix *net.IPNet
+						prefix, err = conf.ParseAllowedIP(prefixStr)
+						if err != nil {
+							err = fmt.Errorf("failed to parse prefix %s in \"allowed-ips=%s\" of %s: %w", prefixStr, pair.Value, confPath, err)
+							return
+						}
+						peer.AllowedIPs = append(peer.AllowedIPs, *prefix)
+					}
+				case "endpoint":
+					var hostEndpoint string
+					peer.Endpoint, hostEndpoint, err = wgconf.ParseEndpoint(pair.Value)
+					if err != nil {
+						err = fmt.Errorf("failed to parse endpoint in \"endpoint=%s\" of %s: %w", pair.Value, confPath, err)
+						return
+					}
+					if hostEndpoint != "" {
+						conf.AddHostEndpoint(peer.PublicKey, hostEndpoint)
+					}
+				case "persistent-keepalive":
+					var keepalive int
+					keepalive, err = strconv.Atoi(pair.Value)
+					if err != nil {
+						err = fmt.Errorf("failed to parse persistent keepalive in \"persistent-keepalive=%s\" of %s: %w", pair.Value, confPath, err)
+						return
+					}
+					if keepalive < 0 || keepalive > 65535 {
+						err = fmt.Errorf("invalid persistent keepalive %d", keepalive)
+						return
+					}
+					keepaliveDuration := time.Duration(keepalive) * time.Second
+					peer.PersistentKeepaliveInterval = &keepaliveDuration
+				default:
+					log.Printf("[warn] unknown key in [%s] section of %s: %s=%s, ignored", section.Name, confPath, pair.Key, pair.Value)
+				}
+			}
+			conf.WireGuard.Peers = append(conf.WireGuard.Peers, peer)
+		case section.Name == "ipv4", section.Name == "ipv6":
+			family := 0
+			if section.Name == "ipv6" {
+				family = 1
+			}
+			if method := lookupValue(keyFile, section.Name, "method"); method != "" && method != "manual" {
+				if method != "disabled" && method != "ignore" {
+					log.Printf("[warn] method=%s in [%s] section of %s is not supported, treated as disabled", method, section.Name, confPath)
+				}
+				continue
+			}
+			for _, pair := range section.Pairs {
+				switch {
+				case pair.Key == "address" || pair.Key == "addresses" || isNumbered(pair.Key, "address"):
+					for _, addrStr := range strings.Split(pair.Value, ";") {
+						addrStr = strings.TrimSpace(addrStr)
+						if addrStr == "" {
+							continue
+						}
+						// the optional gateway after the comma is meaningless for a wireguard interface
+						addrStr, _, _ = strings.Cut(addrStr, ",")
+						var address *net.IPNet
+						address, err = rtnl.ParseAddr(addrStr)
+						if err != nil {
+							err = fmt.Errorf("failed to parse address %s in \"%s=%s\" of %s: %w", addrStr, pair.Key, pair.Value, confPath, err)
+							return
+						}
+						networkConf.Addresses = append(networkConf.Addresses, *address)
+					}
+				case pair.Key == "routes" || isNumbered(pair.Key, "route"):
+					for _, routeStr := range strings.Split(pair.Value, ";") {
+						routeStr = strings.TrimSpace(routeStr)
+						if routeStr == "" {
+							continue
+						}
+						var route *netconf.Route
+						route, err = parseRoute(routeStr)
+						if err != nil {
+							err = fmt.Errorf("failed to parse route in \"%s=%s\" of %s: %w", pair.Key, pair.Value, confPath, err)
+							return
+						}
+						if route == nil {
+							log.Printf("[warn] route with next hop in \"%s=%s\" of %s is not supported, ignored", pair.Key, pair.Value, confPath)
+							continue
+						}
+						networkConf.Routes = append(networkConf.Routes, *route)
+					}
+				case pair.Key == "route-table":
+					var table uint64
+					table, err = strconv.ParseUint(pair.Value, 10, 32)
+					if err != nil {
+						err = fmt.Errorf("failed to parse route table in \"route-table=%s\" of %s: %w", pair.Value, confPath, err)
+						return
+					}
+					if table != 0 {
+						table32 := uint32(table)
+						routeTables[family] = &table32
+					}
+				case pair.Key == "route-metric":
+					var metric int64
+					metric, err = strconv.ParseInt(pair.Value, 10, 64)
+					if err != nil {
+						err = fmt.Errorf("failed to parse route metric in \"route-metric=%s\" of %s: %w", pair.Value, confPath, err)
+						return
+					}
+					if metric >= 0 && metric <= 1<<32-1 {
+						metric32 := uint32(metric)
+						routeMetrics[family] = &metric32
+					}
+				}
+			}
+		}
+	}
+
+	familyOf := func(prefix net.IPNet) int {
+		if prefix.IP.To4() != nil {
+			return 0
+		}
+		return 1
+	}
+
+	// the routes in [ipv4] and [ipv6] go into route-table with route-metric as the default metric
+	for i := range networkConf.Routes {
+		route := &networkConf.Routes[i]
+		family := familyOf(route.Destination)
+		route.Table = routeTables[family]
+		if route.Metric == nil {
+			route.Metric = routeMetrics[family]
+		}
+	}
+
+	if peerRoutes {
+		for _, peer := range conf.WireGuard.Peers {
+			for _, prefix := range peer.AllowedIPs {
+				family := familyOf(prefix)
+				networkConf.Routes = append(networkConf.Routes, netconf.Route{
+					Destination: prefix,
+					Table:       routeTables[family],
+					Metric:      routeMetrics[family],
+				})
+			}
+		}
+	}
+
+	return
+}
+
+func isNumbered(key, prefix string) bool {
+	if !strings.HasPrefix(key, prefix) {
+		return false
+	}
+	_, err := strconv.ParseUint(strings.TrimPrefix(key, prefix), 10, 32)
+	return err == nil
+}
+
+func parsePrefix(prefixStr string) (prefix *net.IPNet, err error) {
+	if !strings.Contains(prefixStr, "/") {
+		// a single address
+		if strings.Contains(prefixStr, ":") {
+			prefixStr += "/128"
+		} else {
+			prefixStr += "/32"
+		}
+	}
+	_, prefix, err = net.ParseCIDR(prefixStr)
+	return
+}
+
+// parseRoute parses "dest/prefix[,next-hop[,metric]]", a nil route is returned
+// for routes with a next hop, which is not supported.
+func parseRoute(routeStr string) (route *netconf.Route, err error) {
+	fields := strings.Split(routeStr, ",")
+	prefix, err := parsePrefix(strings.TrimSpace(fields[0]))
+	if err != nil {
+		return
+	}
+	var metric *uint32
+	if len(fields) > 1 {
+		nextHop := net.ParseIP(strings.TrimSpace(fields[1]))
+		if nextHop != nil && !nextHop.IsUnspecified() {
+			return
+		}
+	}
+	if len(fields) > 2 {
+		var metric64 uint64
+		metric64, err = strconv.ParseUint(strings.TrimSpace(fields[2]), 10, 32)
+		if err != nil {
+			return
+		}
+		metric32 := uint32(metric64)
+		metric = &metric32
+	}
+	route = &netconf.Route{
+		Destination: *prefix,
+		Metric:      metric,
+	}
+	return
+}
+
+func findConnection(opts *wgconf.ParserOptions, ifceName string) (confPath string, keyFile ini.File, err error) {
+	entries, err := os.ReadDir(systemConnectionsDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+			return
+		}
+		err = fmt.Errorf("failed to read dir %s: %w", systemConnectionsDir, err)
+		return
+	}
+	var names []string
+	for _, entry := range entries {
+		if path.Ext(entry.Name()) == ".nmconnection" {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := filepath.Join(systemConnectionsDir, name)
+		var f ini.File
+		f, err = parseKeyFile(opts, p)
+		if err != nil {
+			return
+		}
+		if lookupValue(f, "connection", "type") != "wireguard" {
+			continue
+		}
+		if lookupValue(f, "connection", "interface-name") != ifceName {
+			continue
+		}
+		confPath = p
+		keyFile = f
+		return
+	}
+	return
+}
+
+func parseKeyFile(opts *wgconf.ParserOptions, confPath string) (file ini.File, err error) {
+	confFile, err := opts.Open(confPath)
+	if err != nil {
+		err = fmt.Errorf("failed to open conf file %s: %w", confPath, err)
+		return
+	}
+	defer confFile.Close()
+
+	file, err = ini.ParseINI(confFile)
+	if err != nil {
+		err = fmt.Errorf("failed to parse conf file %s: %w", confPath, err)
+		return
+	}
+	return
+}
+
+func lookupValue(f ini.File, sectionName, key string) (value string) {
+	for _, section := range f {
+		if section.Name != sectionName {
+			continue
+		}
+		for _, pair := range section.Pairs {
+			if pair.Key == key {
+				value = pair.Value
+			}
+		}
+	}
+	return
+}
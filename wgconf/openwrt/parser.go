@@ -0,0 +1,383 @@
+package openwrt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/haruue-net/wg-apply/netconf"
+	"github.com/haruue-net/wg-apply/uci"
+	"github.com/haruue-net/wg-apply/wgconf"
+	"github.com/jsimonetti/rtnetlink/rtnl"
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"log"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	wgconf.RegisterParser(wgconf.ParserRegistration{
+		Name:        "openwrt",
+		Priority:    50,
+		Description: "OpenWrt netifd interfaces with proto wireguard in " + networkConfPath,
+		Probe:       probe,
+		Parse:       parse,
+	})
+}
+
+const networkConfPath = "/etc/config/network"
+
+func probe(ctx context.Context) (err error) {
+	opts := wgconf.ExtractParserOptions(ctx)
+	if opts == nil {
+		err = errors.New("missing parser options")
+		return
+	}
+	if opts.Path != "" && !opts.IsStdin() {
+		absPath, aerr := filepath.Abs(opts.Path)
+		if aerr != nil {
+			absPath = opts.Path
+		}
+		if absPath != networkConfPath {
+			err = wgconf.ProbeMismatch("%s is not %s", opts.Path, networkConfPath)
+			return
+		}
+	}
+	_, _, _, err = loadInterface(opts)
+	if err != nil {
+		err = wgconf.ProbeMismatch("%v", err)
+		return
+	}
+	return
+}
+
+func loadInterface(opts *wgconf.ParserOptions) (confPath string, uciFile uci.File, ifceSection *uci.Section, err error) {
+	confPath = opts.Path
+	if confPath == "" {
+		confPath = networkConfPath
+		if ferr := unix.Access(confPath, unix.R_OK); ferr != nil {
+			err = fmt.Errorf("failed to access conf file %s: %w", confPath, ferr)
+			return
+		}
+	}
+
+	confFile, err := opts.Open(confPath)
+	if err != nil {
+		err = fmt.Errorf("failed to open conf file %s: %w", confPath, err)
+		return
+	}
+	defer confFile.Close()
+
+	uciFile, err = uci.ParseUCI(confFile)
+	if err != nil {
+		err = fmt.Errorf("failed to parse conf file %s: %w", confPath, err)
+		return
+	}
+
+	for i := range uciFile {
+		section := &uciFile[i]
+		if section.Type != "interface" || section.Get("proto") != "wireguard" {
+			continue
+		}
+		if opts.Interface != "" {
+			if section.Name == opts.Interface {
+				ifceSection = section
+			}
+			continue
+		}
+		if ifceSection != nil {
+			err = fmt.Errorf("more than one wireguard interface in %s, please specify the interface name", confPath)
+			return
+		}
+		ifceSection = section
+	}
+	if ifceSection == nil {
+		err = fmt.Errorf("no wireguard interface %s found in %s", opts.Interface, confPath)
+		return
+	}
+	return
+}
+
+func parse(ctx context.Context) (conf *wgconf.Config, err error) {
+	opts := wgconf.ExtractParserOptions(ctx)
+	if opts == nil {
+		err = errors.New("missing parser options")
+		return
+	}
+	if opts.Interface == "" && opts.Path == "" {
+		err = errors.New("missing interface name or conf file path")
+		return
+	}
+
+	confPath, uciFile, ifceSection, err := loadInterface(opts)
+	if err != nil {
+		return
+	}
+
+	// netifd names the wireguard device after the logical interface
+	ifceName := ifceSection.Name
+
+	networkConf := &netconf.NetworkConfig{
+		Device: ifceName,
+	}
+
+	conf = &wgconf.Config{
+		Interface: ifceName,
+		WireGuard: wgtypes.Config{},
+		Network:   networkConf,
+	}
+
+	posErr := func(line int, err error) error {
+		return fmt.Errorf("%s:%d: %w", confPath, line, err)
+	}
+
+	var routeTables [2]*uint32
+	for _, opt := range ifceSection.Options {
+		value := opt.Values[len(opt.Values)-1]
+		switch opt.Name {
+		case "private_key":
+			var privkey wgtypes.Key
+			privkey, err = wgtypes.ParseKey(value)
+			if err != nil {
+				err = posErr(opt.Line, fmt.Errorf("failed to parse private key: %w", err))
+				return
+			}
+			conf.WireGuard.PrivateKey = &privkey
+		case "listen_port":
+			var port int
+			port, err = strconv.Atoi(value)
+			if err != nil {
+				err = posErr(opt.Line, fmt.Errorf("failed to parse listen port %s: %w", value, err))
+				return
+			}
+			if port < 0 || port > 65535 {
+				err = posErr(opt.Line, fmt.Errorf("invalid listen port %d", port))
+				return
+			}
+			conf.WireGuard.ListenPort = &port
+		case "fwmark":
+			var fwmark64 uint64
+			fwmark64, err = strconv.ParseUint(value, 0, 32)
+			if err != nil {
+				err = posErr(opt.Line, fmt.Errorf("failed to parse fwmark %s: %w", value, err))
+				return
+			}
+			fwmark := int(uint32(fwmark64))
+			conf.WireGuard.FirewallMark = &fwmark
+		case "mtu":
+			var mtu uint64
+			mtu, err = strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				err = posErr(opt.Line, fmt.Errorf("failed to parse MTU %s: %w", value, err))
+				return
+			}
+			if mtu > 65535 {
+				err = posErr(opt.Line, fmt.Errorf("invalid MTU %d", mtu))
+				return
+			}
+			mtu32 := uint32(mtu)
+			networkConf.MTU = &mtu32
+		case "ip4table", "ip6table":
+			var table uint64
+			table, err = strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				err = posErr(opt.Line, fmt.Errorf("failed to parse %s %s: %w", opt.Name, value, err))
+				return
+			}
+			table32 := uint32(table)
+			if opt.Name == "ip4table" {
+				routeTables[0] = &table32
+			} else {
+				routeTables[1] = &table32
+			}
+		}
+	}
+	for _, addrStr := range ifceSection.GetList("addresses") {
+		var address *net.IPNet
+		address, err = rtnl.ParseAddr(addrStr)
+		if err != nil {
+			err = posErr(ifceSection.Line, fmt.Errorf("failed to parse address %s: %w", addrStr, err))
+			return
+		}
+		networkConf.Addresses = append(networkConf.Addresses, *address)
+	}
+
+	tableOf := func(prefix net.IPNet) *uint32 {
+		if prefix.IP.To4() != nil {
+			return routeTables[0]
+		}
+		return routeTables[1]
+	}
+
+	for i := range uciFile {
+		section := &uciFile[i]
+		switch section.Type {
+		case "wireguard_" + ifceName:
+			if section.Get("disabled") == "1" {
+				continue
+			}
+			var peer *wgtypes.PeerConfig
+			var hostEndpoint string
+			var routeAllowedIPs bool
+			peer, hostEndpoint, routeAllowedIPs, err = parsePeer(conf, section)
+			if err != nil {
+				err = posErr(section.Line, err)
+				return
+			}
+			conf.WireGuard.Peers = append(conf.WireGuard.Peers, *peer)
+			if hostEndpoint != "" {
+				conf.AddHostEndpoint(peer.PublicKey, hostEndpoint)
+			}
+			if routeAllowedIPs {
+				for _, prefix := range peer.AllowedIPs {
+					networkConf.Routes = append(networkConf.Routes, netconf.Route{
+						Destination: prefix,
+						Table:       tableOf(prefix),
+					})
+				}
+			}
+		case "route", "route6":
+			if section.Get("interface") != ifceName {
+				continue
+			}
+			var route *netconf.Route
+			route, err = parseRoute(section)
+			if err != nil {
+				err = posErr(section.Line, err)
+				return
+			}
+			if route == nil {
+				log.Printf("[warn] %s:%d: route with gateway is not supported, ignored", confPath, section.Line)
+				continue
+			}
+			if route.Table == nil {
+				route.Table = tableOf(route.Destination)
+			}
+			networkConf.Routes = append(networkConf.Routes, *route)
+		}
+	}
+
+	return
+}
+
+func parsePeer(conf *wgconf.Config, section *uci.Section) (peer *wgtypes.PeerConfig, hostEndpoint string, routeAllowedIPs bool, err error) {
+	peer = &wgtypes.PeerConfig{
+		ReplaceAllowedIPs: true,
+	}
+	peer.PublicKey, err = wgtypes.ParseKey(section.Get("public_key"))
+	if err != nil {
+		err = fmt.Errorf("failed to parse public key: %w", err)
+		return
+	}
+	if pskStr := section.Get("preshared_key"); pskStr != "" {
+		var psk wgtypes.Key
+		psk, err = wgtypes.ParseKey(pskStr)
+		if err != nil {
+			err = fmt.Errorf("failed to parse preshared key: %w", err)
+			return
+		}
+		peer.PresharedKey = &psk
+	}
+	for _, prefixStr := range section.GetList("allowed_ips") {
+		var prefix *net.IPNet
+		prefix, err = conf.ParseAllowedIP(prefixStr)
+		if err != nil {
+			err = fmt.Errorf("failed to parse allowed ip %s: %w", prefixStr, err)
+			return
+		}
+		peer.AllowedIPs = append(peer.AllowedIPs, *prefix)
+	}
+	if host := section.Get("endpoint_host"); host != "" {
+		port := section.Get("endpoint_port")
+		if port == "" {
+			port = "51820"
+		}
+		endpoint := net.JoinHostPort(strings.Trim(host, "[]"), port)
+		peer.Endpoint, hostEndpoint, err = wgconf.ParseEndpoint(endpoint)
+		if err != nil {
+			err = fmt.Errorf("failed to parse endpoint %s: %w", endpoint, err)
+			return
+		}
+	}
+	if keepaliveStr := section.Get("persistent_keepalive"); keepaliveStr != "" {
+		var keepalive int
+		keepalive, err = strconv.Atoi(keepaliveStr)
+		if err != nil {
+			err = fmt.Errorf("failed to parse persistent keepalive %s: %w", keepaliveStr, err)
+			return
+		}
+		if keepalive < 0 || keepalive > 65535 {
+			err = fmt.Errorf("invalid persistent keepalive %d", keepalive)
+			return
+		}
+		keepaliveDuration := time.Duration(keepalive) * time.Second
+		peer.PersistentKeepaliveInterval = &keepaliveDuration
+	}
+	routeAllowedIPs = section.Get("route_allowed_ips") == "1"
+	return
+}
+
+// parseRoute parses "config route" and "config route6", a nil route is
+// returned for routes with a gateway, which is not supported.
+func parseRoute(section *uci.Section) (route *netconf.Route, err error) {
+	if gw := section.Get("gateway"); gw != "" && !net.ParseIP(gw).IsUnspecified() {
+		return
+	}
+	target := section.Get("target")
+	if target == "" {
+		err = errors.New("missing target of route")
+		return
+	}
+	if netmask := section.Get("netmask"); netmask != "" && !strings.Contains(target, "/") {
+		maskIP := net.ParseIP(netmask).To4()
+		if maskIP == nil {
+			err = fmt.Errorf("invalid route netmask %s: not an ipv4 netmask", netmask)
+			return
+		}
+		ones, bits := net.IPMask(maskIP).Size()
+		if bits == 0 {
+			err = fmt.Errorf("invalid route netmask %s: non-contiguous netmask", netmask)
+			return
+		}
+		target = fmt.Sprintf("%s/%d", target, ones)
+	}
+	if !strings.Contains(target, "/") {
+		if section.Type == "route6" {
+			target += "/128"
+		} else {
+			target += "/32"
+		}
+	}
+	_, prefix, err := net.ParseCIDR(target)
+	if err != nil {
+		err = fmt.Errorf("failed to parse route target %s: %w", target, err)
+		return
+	}
+	route = &netconf.Route{
+		Destination: *prefix,
+	}
+	if tableStr := section.Get("table"); tableStr != "" {
+		var table uint64
+		table, err = strconv.ParseUint(tableStr, 10, 32)
+		if err != nil {
+			err = fmt.Errorf("failed to parse route table %s: %w", tableStr, err)
+			return
+		}
+		table32 := uint32(table)
+		route.Table = &table32
+	}
+	if metricStr := section.Get("metric"); metricStr != "" {
+		var metric uint64
+		metric, err = strconv.ParseUint(metricStr, 10, 32)
+		if err != nil {
+			err = fmt.Errorf("failed to parse route metric %s: %w", metricStr, err)
+			return
+		}
+		metric32 := uint32(metric)
+		route.Metric = &metric32
+	}
+	return
+}
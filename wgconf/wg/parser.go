@@ -0,0 +1,295 @@
+package wg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/haruue-net/wg-apply/ini"
+	"github.com/haruue-net/wg-apply/wgconf"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	wgconf.RegisterParser(wgconf.ParserRegistration{
+		Name:        "wg",
+		Priority:    100,
+		Description: "wg(8) config, such as the output of wg showconf, without network config",
+		Probe:       probe,
+		Parse:       parse,
+	})
+}
+
+func probe(ctx context.Context) (err error) {
+	opts := wgconf.ExtractParserOptions(ctx)
+	if opts == nil {
+		err = errors.New("missing parser options")
+		return
+	}
+	if opts.Path == "" {
+		err = wgconf.ProbeMismatch("a conf file path is required")
+		return
+	}
+	if !opts.IsStdin() {
+		absPath, aerr := filepath.Abs(opts.Path)
+		if aerr != nil {
+			absPath = opts.Path
+		}
+		for _, dir := range opts.SearchPath {
+			if absDir, aerr := filepath.Abs(dir); aerr == nil && filepath.Dir(absPath) == absDir {
+				err = wgconf.ProbeMismatch("%s is in the search path of wg-quick", opts.Path)
+				return
+			}
+		}
+	}
+	content, err := opts.ReadFile(opts.Path)
+	if err != nil {
+		err = wgconf.ProbeMismatch("failed to read conf file %s: %v", opts.Path, err)
+		return
+	}
+	err = sniffConf(content)
+	if err != nil {
+		err = wgconf.ProbeMismatch("%s %v", opts.Path, err)
+		return
+	}
+	return
+}
+
+// wgQuickKeys are the keys of [Interface] only understood by wg-quick(8), and
+// by the wg-quick parser of wg-apply.
+var wgQuickKeys = []string{"address", "dns", "mtu", "table", "preup", "postup", "predown", "postdown", "saveconfig", "privatekeyfile", "include"}
+
+// sniffConf only looks for an [Interface] or [Peer] section without the keys
+// of wg-quick, the errors in the conf are left to parse to report.
+func sniffConf(content []byte) (err error) {
+	hasSection := false
+	section := ""
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			if section == "interface" || section == "peer" {
+				hasSection = true
+			}
+			continue
+		}
+		key, _, ok := strings.Cut(line, "=")
+		if !ok || section != "interface" {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		for _, k := range wgQuickKeys {
+			if strings.EqualFold(key, k) {
+				err = fmt.Errorf("has wg-quick key %s", key)
+				return
+			}
+		}
+	}
+	if !hasSection {
+		err = errors.New("has no [Interface] or [Peer] section")
+		return
+	}
+	return
+}
+
+func parse(ctx context.Context) (conf *wgconf.Config, err error) {
+	opts := wgconf.ExtractParserOptions(ctx)
+	if opts == nil {
+		err = errors.New("missing parser options")
+		return
+	}
+	if opts.Path == "" {
+		err = errors.New("missing conf file path")
+		return
+	}
+
+	ifceName := opts.Interface
+	if ifceName == "" {
+		ifceName = strings.TrimSuffix(path.Base(opts.Path), ".conf")
+	}
+
+	conf, err = loadConfFile(opts)
+	if err != nil {
+		return
+	}
+	conf.Interface = ifceName
+	return
+}
+
+func loadConfFile(opts *wgconf.ParserOptions) (conf *wgconf.Config, err error) {
+	confFile, err := opts.Open(opts.Path)
+	if err != nil {
+		err = fmt.Errorf("failed to open conf file %s: %w", opts.Path, err)
+		return
+	}
+	defer confFile.Close()
+
+	conf, err = ParseConf(confFile, opts.Path)
+	return
+}
+
+// ParseConfFile parses a wg(8) config file, for the parsers of other formats
+// which refer to one, such as "wg setconf wg0 /etc/wireguard/wg0.conf". The
+// Interface of the returned conf is left empty, and Network is always nil as
+// wg(8) config has nothing about the network.
+func ParseConfFile(confPath string) (conf *wgconf.Config, err error) {
+	confFile, err := os.Open(confPath)
+	if err != nil {
+		err = fmt.Errorf("failed to open conf file %s: %w", confPath, err)
+		return
+	}
+	defer confFile.Close()
+
+	conf, err = ParseConf(confFile, confPath)
+	return
+}
+
+// ParseConf parses a wg(8) config from r, confPath is only for error messages.
+func ParseConf(r io.Reader, confPath string) (conf *wgconf.Config, err error) {
+	iniFile, err := ini.ParseINI(r)
+	if err != nil {
+		err = fmt.Errorf("failed to parse conf file %s: %w", confPath, err)
+		return
+	}
+
+	conf = &wgconf.Config{}
+	err = parseWireGuard(iniFile, conf)
+	if err != nil {
+		conf = nil
+		err = fmt.Errorf("invalid conf file %s: %w", confPath, err)
+		return
+	}
+	return
+}
+
+// parseWireGuard follows the grammar of wg(8), where section names and keys
+// are case-insensitive.
+func parseWireGuard(iniFile ini.File, conf *wgconf.Config) (err error) {
+	wgConf := &conf.WireGuard
+	for _, section := range iniFile {
+		switch strings.ToLower(section.Name) {
+		case "interface":
+			for _, pair := range section.Pairs {
+				switch strings.ToLower(pair.Key) {
+				case "privatekey":
+					var privkey wgtypes.Key
+					privkey, err = wgtypes.ParseKey(pair.Value)
+					if err != nil {
+						err = fmt.Errorf("failed to parse private key in \"PrivateKey = %s\": %w", pair.Value, err)
+						return
+					}
+					wgConf.PrivateKey = &privkey
+				case "listenport":
+					var port int
+					port, err = strconv.Atoi(pair.Value)
+					if err != nil {
+						err = fmt.Errorf("failed to parse listen port in \"ListenPort = %s\": %w", pair.Value, err)
+						return
+					}
+					if port < 0 || port > 65535 {
+						err = fmt.Errorf("invalid listen port %d", port)
+						return
+					}
+					wgConf.ListenPort = &port
+				case "fwmark":
+					fwmark := 0
+					if pair.Value != "off" {
+						var fwmark64 uint64
+						fwmark64, err = strconv.ParseUint(pair.Value, 0, 32)
+						if err != nil {
+							err = fmt.Errorf("failed to parse fwmark in \"FwMark = %s\": %w", pair.Value, err)
+							return
+						}
+						fwmark = int(uint32(fwmark64))
+					}
+					wgConf.FirewallMark = &fwmark
+				default:
+					err = fmt.Errorf("unknown key-value pair in [Interface] section: %s = %s", pair.Key, pair.Value)
+					return
+				}
+			}
+		case "peer":
+			peer := wgtypes.PeerConfig{
+				ReplaceAllowedIPs: true,
+			}
+			var hostEndpoint string
+			for _, pair := range section.Pairs {
+				switch strings.ToLower(pair.Key) {
+				case "publickey":
+					var pubkey wgtypes.Key
+					pubkey, err = wgtypes.ParseKey(pair.Value)
+					if err != nil {
+						err = fmt.Errorf("failed to parse public key in \"PublicKey = %s\": %w", pair.Value, err)
+						return
+					}
+					peer.PublicKey = pubkey
+				case "presharedkey":
+					var psk wgtypes.Key
+					psk, err = wgtypes.ParseKey(pair.Value)
+					if err != nil {
+						err = fmt.Errorf("failed to parse preshared key in \"PresharedKey = %s\": %w", pair.Value, err)
+						return
+					}
+					peer.PresharedKey = &psk
+				case "allowedips":
+					prefixes := strings.Split(pair.Value, ",")
+					for _, prefixStr := range prefixes {
+						prefixStr = strings.TrimSpace(prefixStr)
+						if prefixStr == "" {
+							continue
+						}
+						var prefix *net.IPNet
+						prefix, err = conf.ParseAllowedIP(prefixStr)
+						if err != nil {
+							err = fmt.Errorf("failed to parse prefix %s in \"AllowedIPs = %s\": %w", prefixStr, pair.Value, err)
+							return
+						}
+						peer.AllowedIPs = append(peer.AllowedIPs, *prefix)
+					}
+				case "endpoint":
+					peer.Endpoint, hostEndpoint, err = wgconf.ParseEndpoint(pair.Value)
+					if err != nil {
+						err = fmt.Errorf("failed to parse endpoint in \"Endpoint = %s\": %w", pair.Value, err)
+						return
+					}
+				case "persistentkeepalive":
+					keepalive := 0
+					if pair.Value != "off" {
+						keepalive, err = strconv.Atoi(pair.Value)
+						if err != nil {
+							err = fmt.Errorf("failed to parse persistent keepalive in \"PersistentKeepalive = %s\": %w", pair.Value, err)
+							return
+						}
+						if keepalive < 0 || keepalive > 65535 {
+							err = fmt.Errorf("invalid persistent keepalive %d", keepalive)
+							return
+						}
+					}
+					keepaliveDuration := time.Duration(keepalive) * time.Second
+					peer.PersistentKeepaliveInterval = &keepaliveDuration
+				default:
+					err = fmt.Errorf("unknown key-value pair in [Peer] section: %s = %s", pair.Key, pair.Value)
+					return
+				}
+			}
+			wgConf.Peers = append(wgConf.Peers, peer)
+			if hostEndpoint != "" {
+				conf.AddHostEndpoint(peer.PublicKey, hostEndpoint)
+			}
+		default:
+			err = fmt.Errorf("unknown section: [%s]", section.Name)
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,57 @@
+package wg_test
+
+import (
+	"context"
+	"github.com/haruue-net/wg-apply/wgconf"
+	_ "github.com/haruue-net/wg-apply/wgconf/wg"
+	_ "github.com/haruue-net/wg-apply/wgconf/wgquick"
+	"strings"
+	"testing"
+)
+
+func TestParseSourceSniffing(t *testing.T) {
+	const peer = `
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+AllowedIPs = 10.0.0.2/32
+`
+	for _, tc := range []struct {
+		name    string
+		content string
+		// parser is "wg" or "wg-quick", told by whether there is a network
+		// config, or "" for an error
+		parser string
+	}{
+		{"showconf", "[Interface]\nPrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=\nListenPort = 51820\n" + peer, "wg"},
+		{"peers only", peer, "wg"},
+		{"wg-quick address", "[Interface]\nPrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=\nAddress = 10.0.0.1/24\n" + peer, "wg-quick"},
+		{"wg-quick mtu", "[Interface]\nPrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=\nMTU = 1420\n" + peer, "wg-quick"},
+		{"wg-quick key in comment", "[Interface]\nPrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=\n# Address = 10.0.0.1/24\n" + peer, "wg"},
+		{"no section", "PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=\n", ""},
+	} {
+		conf, err := wgconf.Parse(context.Background(), "", wgconf.ParserOptions{
+			Interface: "wg0",
+			Source:    strings.NewReader(tc.content),
+		})
+		if tc.parser == "" {
+			if err == nil {
+				t.Errorf("%s: Parse succeeded, want an error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Parse failed: %v", tc.name, err)
+			continue
+		}
+		parser := "wg"
+		if conf.Network != nil {
+			parser = "wg-quick"
+		}
+		if parser != tc.parser {
+			t.Errorf("%s: parsed by %s, want %s", tc.name, parser, tc.parser)
+		}
+		if conf.Interface != "wg0" {
+			t.Errorf("%s: Interface = %q, want wg0", tc.name, conf.Interface)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package wgquick
+
+import (
+	"fmt"
+	"github.com/haruue-net/wg-apply/ini"
+	"github.com/haruue-net/wg-apply/wgconf"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const includeKey = "Include"
+
+// loadConfFile parses confPath along with the drop-ins in confPath.d/*.conf,
+// in lexical order.
+func loadConfFile(opts *wgconf.ParserOptions, confPath string) (file ini.File, err error) {
+	visited := map[string]bool{}
+	file, err = loadIncludedFile(opts, confPath, visited)
+	if err != nil {
+		return
+	}
+	if confPath == wgconf.StdinPath {
+		// no drop-ins for stdin
+		return
+	}
+
+	dropIns, err := filepath.Glob(filepath.Join(confPath+".d", "*.conf"))
+	if err != nil {
+		err = fmt.Errorf("failed to list drop-ins of %s: %w", confPath, err)
+		return
+	}
+	sort.Strings(dropIns)
+	for _, dropIn := range dropIns {
+		var f ini.File
+		f, err = loadIncludedFile(opts, dropIn, visited)
+		if err != nil {
+			return
+		}
+		file = append(file, f...)
+	}
+	return
+}
+
+// loadIncludedFile parses confPath, the sections from "Include = path/glob"
+// are inserted right after the section containing the Include key.
+func loadIncludedFile(opts *wgconf.ParserOptions, confPath string, visited map[string]bool) (file ini.File, err error) {
+	absPath, err := filepath.Abs(confPath)
+	if err != nil {
+		err = fmt.Errorf("failed to get absolute path of %s: %w", confPath, err)
+		return
+	}
+	if visited[absPath] {
+		err = fmt.Errorf("conf file %s is included more than once", confPath)
+		return
+	}
+	visited[absPath] = true
+
+	confFile, err := opts.Open(confPath)
+	if err != nil {
+		err = fmt.Errorf("failed to open conf file %s: %w", confPath, err)
+		return
+	}
+	defer confFile.Close()
+
+	iniFile, err := ini.ParseINI(confFile)
+	if err != nil {
+		err = fmt.Errorf("failed to parse conf file %s: %w", confPath, err)
+		return
+	}
+
+	for _, section := range iniFile {
+		section.File = confPath
+		var includes []ini.Pair
+		var pairs []ini.Pair
+		for _, pair := range section.Pairs {
+			if pair.Key == includeKey {
+				includes = append(includes, pair)
+				continue
+			}
+			pairs = append(pairs, pair)
+		}
+		section.Pairs = pairs
+		file = append(file, section)
+
+		for _, include := range includes {
+			pattern := include.Value
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(filepath.Dir(confPath), pattern)
+			}
+			var matches []string
+			matches, err = filepath.Glob(pattern)
+			if err != nil {
+				err = fmt.Errorf("%s:%d: invalid pattern in \"Include = %s\": %w", confPath, include.Line, include.Value, err)
+				return
+			}
+			if len(matches) == 0 && !hasGlobMeta(include.Value) {
+				err = fmt.Errorf("%s:%d: included file %s not found: %w", confPath, include.Line, pattern, os.ErrNotExist)
+				return
+			}
+			sort.Strings(matches)
+			for _, match := range matches {
+				var f ini.File
+				f, err = loadIncludedFile(opts, match, visited)
+				if err != nil {
+					err = fmt.Errorf("%s:%d: %w", confPath, include.Line, err)
+					return
+				}
+				file = append(file, f...)
+			}
+		}
+	}
+	return
+}
+
+func hasGlobMeta(pattern string) bool {
+	for _, c := range pattern {
+		switch c {
+		case '*', '?', '[', '\\':
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package wgquick
+
+import (
+	"errors"
+	"fmt"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const credentialPrefix = "credential:"
+
+// resolveKeyFile resolves "credential:NAME" against $CREDENTIALS_DIRECTORY set
+// by systemd LoadCredential=, and relative paths against confDir.
+func resolveKeyFile(value, confDir string) (keyPath string, err error) {
+	if strings.HasPrefix(value, credentialPrefix) {
+		name := strings.TrimPrefix(value, credentialPrefix)
+		// "." and ".." would resolve to the dir itself or outside of it
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") || filepath.Clean(name) != name {
+			err = fmt.Errorf("invalid credential name %q", name)
+			return
+		}
+		credDir := os.Getenv("CREDENTIALS_DIRECTORY")
+		if credDir == "" {
+			err = errors.New("$CREDENTIALS_DIRECTORY is not set, credentials are only available with systemd LoadCredential=")
+			return
+		}
+		keyPath = filepath.Join(credDir, name)
+		return
+	}
+	keyPath = value
+	if !filepath.IsAbs(keyPath) {
+		keyPath = filepath.Join(confDir, keyPath)
+	}
+	return
+}
+
+func readKeyFile(value, confDir string) (key wgtypes.Key, err error) {
+	keyPath, err := resolveKeyFile(value, confDir)
+	if err != nil {
+		return
+	}
+	f, err := os.Open(keyPath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+	if perm := fi.Mode().Perm(); perm&0044 != 0 {
+		err = fmt.Errorf("key file %s is readable by group or others (mode %04o), please chmod go-rwx", keyPath, perm)
+		return
+	}
+	content, err := io.ReadAll(io.LimitReader(f, 4096))
+	if err != nil {
+		return
+	}
+	key, err = wgtypes.ParseKey(strings.TrimSpace(string(content)))
+	return
+}
@@ -0,0 +1,37 @@
+package wgquick
+
+import (
+	"testing"
+)
+
+func TestResolveKeyFile(t *testing.T) {
+	t.Setenv("CREDENTIALS_DIRECTORY", "/run/credentials/wg-apply.service")
+	for _, tc := range []struct {
+		value   string
+		keyPath string
+	}{
+		{"credential:wg0.key", "/run/credentials/wg-apply.service/wg0.key"},
+		{"credential:", ""},
+		{"credential:.", ""},
+		{"credential:..", ""},
+		{"credential:../wg0.key", ""},
+		{"credential:wg0/../../wg0.key", ""},
+		{"wg0.key", "/etc/wireguard/wg0.key"},
+		{"/etc/wg0.key", "/etc/wg0.key"},
+	} {
+		keyPath, err := resolveKeyFile(tc.value, "/etc/wireguard")
+		if tc.keyPath == "" {
+			if err == nil {
+				t.Errorf("resolveKeyFile(%q) = %q, want an error", tc.value, keyPath)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("resolveKeyFile(%q) failed: %v", tc.value, err)
+			continue
+		}
+		if keyPath != tc.keyPath {
+			t.Errorf("resolveKeyFile(%q) = %q, want %q", tc.value, keyPath, tc.keyPath)
+		}
+	}
+}
@@ -12,7 +12,6 @@ import (
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	"log"
 	"net"
-	"os"
 	"path"
 	"path/filepath"
 	"strconv"
@@ -21,66 +20,97 @@ import (
 )
 
 func init() {
-	wgconf.RegisterParser("wg-quick", parse)
+	wgconf.RegisterParser(wgconf.ParserRegistration{
+		Name:        "wg-quick",
+		Priority:    10,
+		Description: "wg-quick(8) <interface>.conf in the search path",
+		Probe:       probe,
+		Parse:       parse,
+	})
 }
 
-func parse(ctx context.Context) (conf *wgconf.Config, err error) {
-	ifceName := ""
-	confPath := ""
-
+func probe(ctx context.Context) (err error) {
 	opts := wgconf.ExtractParserOptions(ctx)
 	if opts == nil {
 		err = errors.New("missing parser options")
 		return
 	}
-	if opts.Interface == "" && opts.Path == "" {
-		err = errors.New("missing interface name or conf file path")
+	if opts.IsStdin() {
+		var iniFile ini.File
+		iniFile, err = loadConfFile(opts, opts.Path)
+		if err != nil {
+			err = wgconf.ProbeMismatch("%v", err)
+			return
+		}
+		if !hasWgQuickKeys(iniFile) {
+			// a plain wg(8) config, which is left to the wg parser
+			err = wgconf.ProbeMismatch("no wg-quick specific keys such as Address found")
+			return
+		}
 		return
 	}
 	if opts.Path != "" {
-		if opts.ProbeParser {
-			absPath, aerr := filepath.Abs(opts.Path)
-			if aerr != nil {
-				absPath = opts.Path
-			}
-			if filepath.Dir(absPath) != "/etc/wireguard" {
-				err = wgconf.ErrProbeParserMismatch
-				return
-			}
-			if path.Ext(absPath) != ".conf" {
-				err = wgconf.ErrProbeParserMismatch
-				return
-			}
+		absPath, aerr := filepath.Abs(opts.Path)
+		if aerr != nil {
+			absPath = opts.Path
+		}
+		if !inSearchPath(opts.SearchPath, filepath.Dir(absPath)) {
+			err = wgconf.ProbeMismatch("%s is not in the search path %s", opts.Path, strings.Join(opts.SearchPath, ":"))
+			return
+		}
+		if path.Ext(absPath) != ".conf" {
+			err = wgconf.ProbeMismatch("%s is not a .conf file", opts.Path)
+			return
 		}
+		return
+	}
+	_, _, err = resolveConfPath(opts)
+	if err != nil {
+		err = wgconf.ProbeMismatch("%v", err)
+		return
+	}
+	return
+}
+
+func resolveConfPath(opts *wgconf.ParserOptions) (ifceName, confPath string, err error) {
+	if opts.Path != "" {
 		confPath = opts.Path
 		if opts.Interface == "" {
 			ifceName = strings.TrimSuffix(path.Base(opts.Path), ".conf")
 		} else {
 			ifceName = opts.Interface
 		}
-	} else /* opts.Interface != "" && opts.Path == "" */ {
-		ifceName = opts.Interface
-		confPath = fmt.Sprintf("/etc/wireguard/%s.conf", ifceName)
-		if ferr := unix.Access(confPath, unix.R_OK); ferr != nil {
-			if opts.ProbeParser {
-				err = wgconf.ErrProbeParserMismatch
-			} else {
-				err = fmt.Errorf("failed to access conf file %s: %w", confPath, ferr)
-			}
+		return
+	}
+	ifceName = opts.Interface
+	var ferr error
+	for _, dir := range opts.SearchPath {
+		confPath = filepath.Join(dir, ifceName+".conf")
+		if ferr = unix.Access(confPath, unix.R_OK); ferr == nil {
 			return
 		}
 	}
+	err = fmt.Errorf("failed to access conf file %s.conf in %s: %w", ifceName, strings.Join(opts.SearchPath, ":"), ferr)
+	return
+}
 
-	confFile, err := os.Open(confPath)
+func parse(ctx context.Context) (conf *wgconf.Config, err error) {
+	opts := wgconf.ExtractParserOptions(ctx)
+	if opts == nil {
+		err = errors.New("missing parser options")
+		return
+	}
+	if opts.Interface == "" && opts.Path == "" {
+		err = errors.New("missing interface name or conf file path")
+		return
+	}
+	ifceName, confPath, err := resolveConfPath(opts)
 	if err != nil {
-		err = fmt.Errorf("failed to open conf file %s: %w", confPath, err)
 		return
 	}
-	defer confFile.Close()
 
-	iniFile, err := ini.ParseINI(confFile)
+	iniFile, err := loadConfFile(opts, confPath)
 	if err != nil {
-		err = fmt.Errorf("failed to parse conf file: %w", err)
 		return
 	}
 
@@ -102,10 +132,20 @@ func parse(ctx context.Context) (conf *wgconf.Config, err error) {
 		rtTables = map[string]uint32{}
 	}
 
+	// the origin of the key-value pair being parsed, for error messages
+	var pairPosition string
+	defer func() {
+		if err != nil && pairPosition != "" {
+			conf = nil
+			err = fmt.Errorf("%s: %w", pairPosition, err)
+		}
+	}()
+
 	for _, section := range iniFile {
 		switch section.Name {
 		case "Interface":
 			for _, pair := range section.Pairs {
+				pairPosition = fmt.Sprintf("%s:%d", section.File, pair.Line)
 				switch pair.Key {
 				case "Address":
 					addrs := strings.Split(pair.Value, ",")
@@ -143,6 +183,14 @@ func parse(ctx context.Context) (conf *wgconf.Config, err error) {
 						return
 					}
 					conf.WireGuard.PrivateKey = &privkey
+				case "PrivateKeyFile":
+					var privkey wgtypes.Key
+					privkey, err = readKeyFile(pair.Value, filepath.Dir(section.File))
+					if err != nil {
+						err = fmt.Errorf("failed to read private key in \"PrivateKeyFile = %s\": %w", pair.Value, err)
+						return
+					}
+					conf.WireGuard.PrivateKey = &privkey
 				case "ListenPort":
 					var port int
 					port, err = strconv.Atoi(pair.Value)
@@ -191,8 +239,47 @@ func parse(ctx context.Context) (conf *wgconf.Config, err error) {
 					}
 					fwmark := int(uint32(fwmark64))
 					conf.WireGuard.FirewallMark = &fwmark
-				case "DNS", "PreUp", "PostUp", "PreDown", "PostDown", "SaveConfig":
-					// unsupported
+				case "DNS":
+					if networkConf.DNS == nil {
+						networkConf.DNS = &netconf.DNS{}
+					}
+					for _, v := range strings.Split(pair.Value, ",") {
+						v = strings.TrimSpace(v)
+						if v == "" {
+							continue
+						}
+						// the same as wg-quick, anything not an IP is a search domain
+						if ip := net.ParseIP(v); ip != nil {
+							networkConf.DNS.Servers = append(networkConf.DNS.Servers, ip)
+						} else {
+							networkConf.DNS.Search = append(networkConf.DNS.Search, v)
+						}
+					}
+				case "PreUp":
+					conf.Hooks.PreUp = append(conf.Hooks.PreUp, pair.Value)
+				case "PostUp":
+					conf.Hooks.PostUp = append(conf.Hooks.PostUp, pair.Value)
+				case "PreDown":
+					conf.Hooks.PreDown = append(conf.Hooks.PreDown, pair.Value)
+				case "PostDown":
+					conf.Hooks.PostDown = append(conf.Hooks.PostDown, pair.Value)
+				case "PostReload":
+					conf.Hooks.PostReload = append(conf.Hooks.PostReload, pair.Value)
+				case "SaveConfig":
+					var save bool
+					save, err = strconv.ParseBool(pair.Value)
+					if err != nil {
+						err = fmt.Errorf("failed to parse \"SaveConfig = %s\": %w", pair.Value, err)
+						return
+					}
+					conf.Save = nil
+					if save && opts.IsStdin() {
+						log.Printf("[warn] %s: SaveConfig is ignored for the config from stdin", pairPosition)
+					} else if save {
+						conf.Save = func(device *wgtypes.Device) error {
+							return saveConfig(opts, confPath, device)
+						}
+					}
 				default:
 					err = fmt.Errorf("unknown key-value pair in [Interface] section: %s = %s", pair.Key, pair.Value)
 					return nil, err
@@ -202,7 +289,9 @@ func parse(ctx context.Context) (conf *wgconf.Config, err error) {
 			peer := wgtypes.PeerConfig{
 				ReplaceAllowedIPs: true,
 			}
+			var hostEndpoint string
 			for _, pair := range section.Pairs {
+				pairPosition = fmt.Sprintf("%s:%d", section.File, pair.Line)
 				switch pair.Key {
 				case "PublicKey":
 					var pubkey wgtypes.Key
@@ -220,6 +309,14 @@ func parse(ctx context.Context) (conf *wgconf.Config, err error) {
 						return
 					}
 					peer.PresharedKey = &psk
+				case "PresharedKeyFile":
+					var psk wgtypes.Key
+					psk, err = readKeyFile(pair.Value, filepath.Dir(section.File))
+					if err != nil {
+						err = fmt.Errorf("failed to read preshared key in \"PresharedKeyFile = %s\": %w", pair.Value, err)
+						return
+					}
+					peer.PresharedKey = &psk
 				case "AllowedIPs":
 					prefixes := strings.Split(pair.Value, ",")
 					for _, prefixStr := range prefixes {
@@ -228,7 +325,7 @@ func parse(ctx context.Context) (conf *wgconf.Config, err error) {
 							continue
 						}
 						var prefix *net.IPNet
-						_, prefix, err = net.ParseCIDR(prefixStr)
+						prefix, err = conf.ParseAllowedIP(prefixStr)
 						if err != nil {
 							err = fmt.Errorf("failed to parse prefix %s in \"AllowedIPs = %s\": %w", prefixStr, pair.Value, err)
 							return
@@ -236,7 +333,7 @@ func parse(ctx context.Context) (conf *wgconf.Config, err error) {
 						peer.AllowedIPs = append(peer.AllowedIPs, *prefix)
 					}
 				case "Endpoint":
-					peer.Endpoint, err = net.ResolveUDPAddr("udp", pair.Value)
+					peer.Endpoint, hostEndpoint, err = wgconf.ParseEndpoint(pair.Value)
 					if err != nil {
 						err = fmt.Errorf("failed to parse endpoint in \"Endpoint = %s\": %w", pair.Value, err)
 						return
@@ -260,16 +357,48 @@ func parse(ctx context.Context) (conf *wgconf.Config, err error) {
 				}
 			}
 			conf.WireGuard.Peers = append(conf.WireGuard.Peers, peer)
+			if hostEndpoint != "" {
+				conf.AddHostEndpoint(peer.PublicKey, hostEndpoint)
+			}
 		}
 	}
+	pairPosition = ""
 
 	if addAllowedIPsAsRoutes {
 		for _, peer := range conf.WireGuard.Peers {
 			for _, prefix := range peer.AllowedIPs {
-				networkConf.Routes = append(networkConf.Routes, prefix)
+				networkConf.Routes = append(networkConf.Routes, netconf.Route{
+					Destination: prefix,
+				})
 			}
 		}
 	}
 
 	return
 }
+
+func inSearchPath(searchPath []string, dir string) bool {
+	for _, d := range searchPath {
+		absDir, err := filepath.Abs(d)
+		if err != nil {
+			absDir = d
+		}
+		if absDir == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// hasWgQuickKeys tells whether the config uses any key unknown to wg(8)
+func hasWgQuickKeys(iniFile ini.File) bool {
+	for _, section := range iniFile {
+		for _, pair := range section.Pairs {
+			switch pair.Key {
+			case "Address", "MTU", "Table", "DNS", "PreUp", "PostUp", "PreDown", "PostDown", "PostReload", "SaveConfig", "PrivateKeyFile", "PresharedKeyFile":
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,282 @@
+package wgquick
+
+import (
+	"fmt"
+	"github.com/haruue-net/wg-apply/ini"
+	"github.com/haruue-net/wg-apply/wgconf"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// saveConfig merges the runtime state of the device into the conf files, for
+// "SaveConfig = true". Peers only in the device are appended to confPath,
+// and the endpoint, allowed IPs and keepalive of existing peers are updated
+// in place,
+// wherever they are included from. Peers only in the conf files are kept, so
+// peers just added to the files are not lost.
+func saveConfig(opts *wgconf.ParserOptions, confPath string, device *wgtypes.Device) (err error) {
+	iniFile, err := loadConfFile(opts, confPath)
+	if err != nil {
+		return
+	}
+
+	editors := map[string]*ini.Editor{}
+	editorOf := func(file string) (editor *ini.Editor, err error) {
+		editor, ok := editors[file]
+		if ok {
+			return
+		}
+		content, err := opts.ReadFile(file)
+		if err != nil {
+			err = fmt.Errorf("failed to read conf file %s: %w", file, err)
+			return
+		}
+		editor = ini.NewEditor(content)
+		editors[file] = editor
+		return
+	}
+
+	sections := map[wgtypes.Key]*ini.Section{}
+	for i := range iniFile {
+		section := &iniFile[i]
+		if section.Name != "Peer" {
+			continue
+		}
+		if pubkey, perr := wgtypes.ParseKey(lookupPair(section, "PublicKey").Value); perr == nil {
+			sections[pubkey] = section
+		}
+	}
+
+	for i := range device.Peers {
+		peer := &device.Peers[i]
+		section, ok := sections[peer.PublicKey]
+		if !ok {
+			var editor *ini.Editor
+			editor, err = editorOf(confPath)
+			if err != nil {
+				return
+			}
+			log.Printf("[#] save peer %s to %s", peer.PublicKey, confPath)
+			editor.Append(renderPeer(peer)...)
+			continue
+		}
+
+		lastLine := section.Line
+		if len(section.Pairs) > 0 {
+			lastLine = section.Pairs[len(section.Pairs)-1].Line
+		}
+
+		if pair := lookupPair(section, "Endpoint"); peer.Endpoint != nil && pair.Line != 0 {
+			// hostnames are kept, as the runtime endpoints are resolved from them
+			addr, perr := parseIPEndpoint(pair.Value)
+			if perr == nil && (!addr.IP.Equal(peer.Endpoint.IP) || addr.Port != peer.Endpoint.Port) {
+				var editor *ini.Editor
+				editor, err = editorOf(section.File)
+				if err != nil {
+					return
+				}
+				log.Printf("[#] save endpoint %s of peer %s to %s:%d", peer.Endpoint, peer.PublicKey, section.File, pair.Line)
+				editor.SetValue(pair.Line, peer.Endpoint.String())
+			}
+		}
+
+		err = saveAllowedIPs(section, peer, lastLine, editorOf)
+		if err != nil {
+			return
+		}
+
+		keepalive := int(peer.PersistentKeepaliveInterval.Seconds())
+		pair := lookupPair(section, "PersistentKeepalive")
+		if pair.Line != 0 {
+			old, perr := strconv.Atoi(pair.Value)
+			if pair.Value == "off" {
+				old, perr = 0, nil
+			}
+			if perr != nil || old != keepalive {
+				var editor *ini.Editor
+				editor, err = editorOf(section.File)
+				if err != nil {
+					return
+				}
+				log.Printf("[#] save persistent keepalive %d of peer %s to %s:%d", keepalive, peer.PublicKey, section.File, pair.Line)
+				editor.SetValue(pair.Line, strconv.Itoa(keepalive))
+			}
+		} else if keepalive != 0 {
+			var editor *ini.Editor
+			editor, err = editorOf(section.File)
+			if err != nil {
+				return
+			}
+			log.Printf("[#] save persistent keepalive %d of peer %s to %s", keepalive, peer.PublicKey, section.File)
+			editor.InsertAfter(lastLine, fmt.Sprintf("PersistentKeepalive = %d", keepalive))
+		}
+	}
+
+	files := make([]string, 0, len(editors))
+	for file := range editors {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		err = writeFileAtomic(file, editors[file].Bytes())
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// saveAllowedIPs updates the AllowedIPs of an existing peer if they are
+// changed at runtime. AllowedIPs split into several lines are not rewritten,
+// as it is not known which line a prefix belongs to.
+func saveAllowedIPs(section *ini.Section, peer *wgtypes.Peer, lastLine int, editorOf func(file string) (*ini.Editor, error)) (err error) {
+	var pairs []ini.Pair
+	conf := &wgconf.Config{}
+	saved := map[string]bool{}
+	for _, pair := range section.Pairs {
+		if pair.Key != "AllowedIPs" {
+			continue
+		}
+		pairs = append(pairs, pair)
+		for _, prefixStr := range strings.Split(pair.Value, ",") {
+			prefixStr = strings.TrimSpace(prefixStr)
+			if prefixStr == "" {
+				continue
+			}
+			prefix, perr := conf.ParseAllowedIP(prefixStr)
+			if perr != nil {
+				log.Printf("[warn] allowed IPs of peer %s in %s:%d are not saved: %v", peer.PublicKey, section.File, pair.Line, perr)
+				return
+			}
+			saved[prefix.String()] = true
+		}
+	}
+
+	prefixes := make([]string, 0, len(peer.AllowedIPs))
+	changed := len(saved) != len(peer.AllowedIPs)
+	for _, prefix := range peer.AllowedIPs {
+		prefixes = append(prefixes, prefix.String())
+		if !saved[prefix.String()] {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	if len(pairs) > 1 {
+		log.Printf("[warn] allowed IPs of peer %s are changed to %s, which are not saved as they are split into several lines in %s", peer.PublicKey, strings.Join(prefixes, ", "), section.File)
+		return
+	}
+
+	editor, err := editorOf(section.File)
+	if err != nil {
+		return
+	}
+	value := strings.Join(prefixes, ", ")
+	if len(pairs) == 1 {
+		log.Printf("[#] save allowed IPs %s of peer %s to %s:%d", value, peer.PublicKey, section.File, pairs[0].Line)
+		editor.SetValue(pairs[0].Line, value)
+	} else {
+		log.Printf("[#] save allowed IPs %s of peer %s to %s", value, peer.PublicKey, section.File)
+		editor.InsertAfter(lastLine, "AllowedIPs = "+value)
+	}
+	return
+}
+
+func lookupPair(section *ini.Section, key string) (pair ini.Pair) {
+	for _, p := range section.Pairs {
+		if p.Key == key {
+			pair = p
+		}
+	}
+	return
+}
+
+// parseIPEndpoint parses endpoints with an IP literal only
+func parseIPEndpoint(s string) (addr *net.UDPAddr, err error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		err = fmt.Errorf("%s is not an IP address", host)
+		return
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return
+	}
+	addr = &net.UDPAddr{IP: ip, Port: portNum}
+	return
+}
+
+func renderPeer(peer *wgtypes.Peer) (lines []string) {
+	lines = append(lines,
+		"",
+		"[Peer]",
+		"# saved by wg-apply from the runtime state",
+		"PublicKey = "+peer.PublicKey.String(),
+	)
+	if peer.PresharedKey != (wgtypes.Key{}) {
+		lines = append(lines, "PresharedKey = "+peer.PresharedKey.String())
+	}
+	if len(peer.AllowedIPs) > 0 {
+		prefixes := make([]string, 0, len(peer.AllowedIPs))
+		for _, prefix := range peer.AllowedIPs {
+			prefixes = append(prefixes, prefix.String())
+		}
+		lines = append(lines, "AllowedIPs = "+strings.Join(prefixes, ", "))
+	}
+	if peer.Endpoint != nil {
+		lines = append(lines, "Endpoint = "+peer.Endpoint.String())
+	}
+	if peer.PersistentKeepaliveInterval != 0 {
+		lines = append(lines, fmt.Sprintf("PersistentKeepalive = %d", int(peer.PersistentKeepaliveInterval.Seconds())))
+	}
+	return
+}
+
+// writeFileAtomic replaces the file with a rename, keeping its permission
+func writeFileAtomic(file string, content []byte) (err error) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		err = fmt.Errorf("failed to stat conf file %s: %w", file, err)
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".")
+	if err != nil {
+		err = fmt.Errorf("failed to create temp file for %s: %w", file, err)
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+	_, err = tmp.Write(content)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to write temp file for %s: %w", file, err)
+		return
+	}
+	err = os.Chmod(tmp.Name(), fi.Mode().Perm())
+	if err != nil {
+		err = fmt.Errorf("failed to chmod temp file for %s: %w", file, err)
+		return
+	}
+	err = os.Rename(tmp.Name(), file)
+	if err != nil {
+		err = fmt.Errorf("failed to replace conf file %s: %w", file, err)
+		return
+	}
+	return
+}
@@ -1,8 +1,49 @@
 package wgdiff
 
-import "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+import (
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"log"
+	"net"
+	"time"
+)
 
-func CalcDiff(current *wgtypes.Device, desired *wgtypes.Config) (diff *wgtypes.Config, err error) {
+// ListenPortPolicy tells what to do with the listen port of the interface
+// when it is missing in the config.
+type ListenPortPolicy string
+
+const (
+	// ListenPortKeep keeps the current listen port
+	ListenPortKeep ListenPortPolicy = "keep"
+	// ListenPortRandom asks the kernel for a new random port, once ListenPort
+	// is removed from the config
+	ListenPortRandom ListenPortPolicy = "random"
+)
+
+type Options struct {
+	// KeepRoamedEndpoints leaves the endpoint of a peer alone if it has a
+	// handshake within this duration from an address other than the
+	// configured one, as the peer has roamed there. 0 disables it.
+	KeepRoamedEndpoints time.Duration
+	// LastEndpoints are the endpoints of the config applied last time. An
+	// endpoint changed in the config since then is applied even if the peer
+	// has roamed.
+	LastEndpoints map[wgtypes.Key]*net.UDPAddr
+	// Additive leaves the runtime values of the fields missing in the config
+	// alone, instead of resetting them to zero.
+	Additive bool
+	// UnsetListenPort is only used when Additive is false.
+	UnsetListenPort ListenPortPolicy
+	// LastListenPort is the ListenPort of the config applied last time, 0 if
+	// it had none. The port is only reset with ListenPortRandom if the
+	// interface still listens on it.
+	LastListenPort int
+}
+
+// CalcDiff compares desired with current field by field, so only the peers
+// changed are in diff, and the existing peers are updated with UpdateOnly
+// and only the fields changed. The fields missing in desired are reset to
+// zero unless opts.Additive.
+func CalcDiff(current *wgtypes.Device, desired *wgtypes.Config, opts Options) (diff *wgtypes.Config, err error) {
 	if current == nil {
 		diff = desired
 		return
@@ -10,9 +51,22 @@ func CalcDiff(current *wgtypes.Device, desired *wgtypes.Config) (diff *wgtypes.C
 
 	diff = &wgtypes.Config{}
 
-	diff.PrivateKey = desired.PrivateKey
-	diff.ListenPort = desired.ListenPort
-	diff.FirewallMark = desired.FirewallMark
+	if desired.PrivateKey != nil && *desired.PrivateKey != current.PrivateKey {
+		diff.PrivateKey = desired.PrivateKey
+	}
+	if desired.ListenPort != nil && *desired.ListenPort != current.ListenPort {
+		diff.ListenPort = desired.ListenPort
+	} else if desired.ListenPort == nil && !opts.Additive && opts.UnsetListenPort == ListenPortRandom &&
+		opts.LastListenPort != 0 && opts.LastListenPort == current.ListenPort {
+		// the kernel always picks a port, so only the port configured last
+		// time tells that ListenPort is just removed
+		diff.ListenPort = new(int)
+	}
+	if desired.FirewallMark != nil && *desired.FirewallMark != current.FirewallMark {
+		diff.FirewallMark = desired.FirewallMark
+	} else if desired.FirewallMark == nil && !opts.Additive && current.FirewallMark != 0 {
+		diff.FirewallMark = new(int)
+	}
 
 	// do not use ReplacePeers as it actually removes all peers first and reset all status.
 
@@ -21,16 +75,27 @@ func CalcDiff(current *wgtypes.Device, desired *wgtypes.Config) (diff *wgtypes.C
 		oldPeers[current.Peers[i].PublicKey] = &current.Peers[i]
 	}
 	newPeers := desired.Peers
-	// we only need to find the deleted peers
-	// all peers that are not intended to be deleted can be updated seamlessly
-	for _, peer := range newPeers {
+
+	diff.Peers = make([]wgtypes.PeerConfig, 0, len(newPeers))
+	for i := range newPeers {
+		peer := &newPeers[i]
+		oldPeer, ok := oldPeers[peer.PublicKey]
+		if !ok {
+			diff.Peers = append(diff.Peers, *peer)
+			continue
+		}
+		// remove common elements, then oldPeers will be the peers to delete
 		delete(oldPeers, peer.PublicKey)
+
+		if peerDiff, changed := calcPeerDiff(oldPeer, peer, opts); changed {
+			diff.Peers = append(diff.Peers, peerDiff)
+		}
 	}
-	// now the oldPeers only contains the peers to be deleted
 
-	diff.Peers = make([]wgtypes.PeerConfig, 0, len(oldPeers)+len(newPeers))
-	diff.Peers = append(diff.Peers, newPeers...)
-	for _, peer := range oldPeers {
+	for _, peer := range current.Peers {
+		if _, ok := oldPeers[peer.PublicKey]; !ok {
+			continue
+		}
 		diff.Peers = append(diff.Peers, wgtypes.PeerConfig{
 			PublicKey: peer.PublicKey,
 			Remove:    true,
@@ -39,3 +104,155 @@ func CalcDiff(current *wgtypes.Device, desired *wgtypes.Config) (diff *wgtypes.C
 
 	return
 }
+
+func calcPeerDiff(oldPeer *wgtypes.Peer, peer *wgtypes.PeerConfig, opts Options) (diff wgtypes.PeerConfig, changed bool) {
+	diff = wgtypes.PeerConfig{
+		PublicKey:  peer.PublicKey,
+		UpdateOnly: true,
+	}
+
+	if peer.PresharedKey != nil && *peer.PresharedKey != oldPeer.PresharedKey {
+		diff.PresharedKey = peer.PresharedKey
+		changed = true
+	} else if peer.PresharedKey == nil && !opts.Additive && oldPeer.PresharedKey != (wgtypes.Key{}) {
+		diff.PresharedKey = &wgtypes.Key{}
+		changed = true
+	}
+
+	if peer.Endpoint != nil && !endpointEqual(peer.Endpoint, oldPeer.Endpoint) {
+		roamed := opts.KeepRoamedEndpoints > 0 && oldPeer.Endpoint != nil &&
+			!oldPeer.LastHandshakeTime.IsZero() && time.Since(oldPeer.LastHandshakeTime) < opts.KeepRoamedEndpoints
+		if last, ok := opts.LastEndpoints[peer.PublicKey]; roamed && ok && !endpointEqual(last, peer.Endpoint) {
+			// changed in the config, rather than by roaming
+			roamed = false
+		}
+		if roamed {
+			log.Printf("keep endpoint %s of peer %s roamed from %s, apply with --keep-roamed-endpoints 0 to reset it", oldPeer.Endpoint, peer.PublicKey, peer.Endpoint)
+		} else {
+			diff.Endpoint = peer.Endpoint
+			changed = true
+		}
+	}
+
+	if peer.PersistentKeepaliveInterval != nil && *peer.PersistentKeepaliveInterval != oldPeer.PersistentKeepaliveInterval {
+		diff.PersistentKeepaliveInterval = peer.PersistentKeepaliveInterval
+		changed = true
+	} else if peer.PersistentKeepaliveInterval == nil && !opts.Additive && oldPeer.PersistentKeepaliveInterval != 0 {
+		diff.PersistentKeepaliveInterval = new(time.Duration)
+		changed = true
+	}
+
+	oldAllowedIPs := make(map[string]bool, len(oldPeer.AllowedIPs))
+	for _, prefix := range oldPeer.AllowedIPs {
+		oldAllowedIPs[prefix.String()] = true
+	}
+	newAllowedIPs := make(map[string]bool, len(peer.AllowedIPs))
+	allowedIPsChanged := false
+	for _, prefix := range peer.AllowedIPs {
+		if !oldAllowedIPs[prefix.String()] {
+			allowedIPsChanged = true
+		}
+		newAllowedIPs[prefix.String()] = true
+	}
+	if peer.ReplaceAllowedIPs && len(newAllowedIPs) != len(oldAllowedIPs) {
+		allowedIPsChanged = true
+	}
+	if allowedIPsChanged {
+		diff.ReplaceAllowedIPs = peer.ReplaceAllowedIPs
+		diff.AllowedIPs = peer.AllowedIPs
+		changed = true
+	}
+	return
+}
+
+func endpointEqual(a, b *net.UDPAddr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
+
+// IsEmpty tells whether applying diff to current changes nothing.
+func IsEmpty(current *wgtypes.Device, diff *wgtypes.Config) bool {
+	if current == nil {
+		return false
+	}
+	if diff.PrivateKey != nil && *diff.PrivateKey != current.PrivateKey {
+		return false
+	}
+	if diff.ListenPort != nil && *diff.ListenPort != current.ListenPort {
+		return false
+	}
+	if diff.FirewallMark != nil && *diff.FirewallMark != current.FirewallMark {
+		return false
+	}
+	if diff.ReplacePeers {
+		return false
+	}
+
+	oldPeers := make(map[wgtypes.Key]*wgtypes.Peer, len(current.Peers))
+	for i := range current.Peers {
+		oldPeers[current.Peers[i].PublicKey] = &current.Peers[i]
+	}
+	for i := range diff.Peers {
+		peer := &diff.Peers[i]
+		oldPeer, ok := oldPeers[peer.PublicKey]
+		if !ok {
+			if peer.Remove || peer.UpdateOnly {
+				continue
+			}
+			return false
+		}
+		if peer.Remove {
+			return false
+		}
+		if peer.PresharedKey != nil && *peer.PresharedKey != oldPeer.PresharedKey {
+			return false
+		}
+		if peer.Endpoint != nil && (oldPeer.Endpoint == nil || !peer.Endpoint.IP.Equal(oldPeer.Endpoint.IP) || peer.Endpoint.Port != oldPeer.Endpoint.Port) {
+			return false
+		}
+		if peer.PersistentKeepaliveInterval != nil && *peer.PersistentKeepaliveInterval != oldPeer.PersistentKeepaliveInterval {
+			return false
+		}
+		oldAllowedIPs := make(map[string]bool, len(oldPeer.AllowedIPs))
+		for _, prefix := range oldPeer.AllowedIPs {
+			oldAllowedIPs[prefix.String()] = true
+		}
+		newAllowedIPs := make(map[string]bool, len(peer.AllowedIPs))
+		for _, prefix := range peer.AllowedIPs {
+			if !oldAllowedIPs[prefix.String()] {
+				return false
+			}
+			newAllowedIPs[prefix.String()] = true
+		}
+		if peer.ReplaceAllowedIPs && len(newAllowedIPs) != len(oldAllowedIPs) {
+			return false
+		}
+	}
+	return true
+}
+
+// ConfigOf returns the config which brings a device back to the state of
+// device with CalcDiff.
+func ConfigOf(device *wgtypes.Device) (config wgtypes.Config) {
+	privateKey := device.PrivateKey
+	listenPort := device.ListenPort
+	firewallMark := device.FirewallMark
+	config.PrivateKey = &privateKey
+	config.ListenPort = &listenPort
+	config.FirewallMark = &firewallMark
+	config.Peers = make([]wgtypes.PeerConfig, 0, len(device.Peers))
+	for i := range device.Peers {
+		peer := &device.Peers[i]
+		config.Peers = append(config.Peers, wgtypes.PeerConfig{
+			PublicKey:                   peer.PublicKey,
+			PresharedKey:                &peer.PresharedKey,
+			Endpoint:                    peer.Endpoint,
+			PersistentKeepaliveInterval: &peer.PersistentKeepaliveInterval,
+			ReplaceAllowedIPs:           true,
+			AllowedIPs:                  peer.AllowedIPs,
+		})
+	}
+	return
+}
@@ -0,0 +1,130 @@
+package wgdiff
+
+import (
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net"
+	"testing"
+	"time"
+)
+
+var peerKey = wgtypes.Key{1}
+
+func TestCalcDiffReset(t *testing.T) {
+	current := &wgtypes.Device{
+		FirewallMark: 0x51820,
+		Peers: []wgtypes.Peer{{
+			PublicKey:                   peerKey,
+			PresharedKey:                wgtypes.Key{2},
+			PersistentKeepaliveInterval: 25 * time.Second,
+		}},
+	}
+	desired := &wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{{PublicKey: peerKey}},
+	}
+	for _, tc := range []struct {
+		additive bool
+		reset    bool
+	}{
+		{false, true},
+		{true, false},
+	} {
+		diff, err := CalcDiff(current, desired, Options{Additive: tc.additive})
+		if err != nil {
+			t.Fatalf("CalcDiff(additive=%v) failed: %v", tc.additive, err)
+		}
+		if reset := diff.FirewallMark != nil && *diff.FirewallMark == 0; reset != tc.reset {
+			t.Errorf("CalcDiff(additive=%v) resets fwmark = %v, want %v", tc.additive, reset, tc.reset)
+		}
+		var peer wgtypes.PeerConfig
+		if len(diff.Peers) == 1 {
+			peer = diff.Peers[0]
+		} else if tc.reset {
+			t.Errorf("CalcDiff(additive=%v) changes %d peers, want 1", tc.additive, len(diff.Peers))
+			continue
+		}
+		if reset := peer.PresharedKey != nil && *peer.PresharedKey == (wgtypes.Key{}); reset != tc.reset {
+			t.Errorf("CalcDiff(additive=%v) resets preshared key = %v, want %v", tc.additive, reset, tc.reset)
+		}
+		if reset := peer.PersistentKeepaliveInterval != nil && *peer.PersistentKeepaliveInterval == 0; reset != tc.reset {
+			t.Errorf("CalcDiff(additive=%v) resets persistent keepalive = %v, want %v", tc.additive, reset, tc.reset)
+		}
+		if empty := IsEmpty(current, diff); empty == tc.reset {
+			t.Errorf("IsEmpty(additive=%v) = %v, want %v", tc.additive, empty, !tc.reset)
+		}
+	}
+}
+
+func TestCalcDiffListenPort(t *testing.T) {
+	current := &wgtypes.Device{ListenPort: 51820}
+	port := func(p int) *int { return &p }
+	for _, tc := range []struct {
+		name       string
+		listenPort *int
+		opts       Options
+		want       *int
+	}{
+		{"keep", nil, Options{UnsetListenPort: ListenPortKeep, LastListenPort: 51820}, nil},
+		{"random on removal", nil, Options{UnsetListenPort: ListenPortRandom, LastListenPort: 51820}, port(0)},
+		{"random never configured", nil, Options{UnsetListenPort: ListenPortRandom}, nil},
+		{"random already picked", nil, Options{UnsetListenPort: ListenPortRandom, LastListenPort: 40000}, nil},
+		{"random additive", nil, Options{Additive: true, UnsetListenPort: ListenPortRandom, LastListenPort: 51820}, nil},
+		{"changed", port(51821), Options{UnsetListenPort: ListenPortRandom, LastListenPort: 51820}, port(51821)},
+		{"unchanged", port(51820), Options{UnsetListenPort: ListenPortRandom, LastListenPort: 51820}, nil},
+	} {
+		diff, err := CalcDiff(current, &wgtypes.Config{ListenPort: tc.listenPort}, tc.opts)
+		if err != nil {
+			t.Errorf("%s: CalcDiff failed: %v", tc.name, err)
+			continue
+		}
+		switch {
+		case tc.want == nil && diff.ListenPort != nil:
+			t.Errorf("%s: ListenPort = %d, want unchanged", tc.name, *diff.ListenPort)
+		case tc.want != nil && diff.ListenPort == nil:
+			t.Errorf("%s: ListenPort unchanged, want %d", tc.name, *tc.want)
+		case tc.want != nil && *diff.ListenPort != *tc.want:
+			t.Errorf("%s: ListenPort = %d, want %d", tc.name, *diff.ListenPort, *tc.want)
+		}
+	}
+}
+
+func TestCalcDiffRoamedEndpoint(t *testing.T) {
+	configured := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51820}
+	roamed := &net.UDPAddr{IP: net.ParseIP("203.0.113.2"), Port: 51820}
+	previous := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 51820}
+	for _, tc := range []struct {
+		name      string
+		keep      time.Duration
+		handshake time.Duration
+		last      *net.UDPAddr
+		applied   bool
+	}{
+		{"disabled", 0, time.Minute, configured, true},
+		{"roamed", 3 * time.Minute, time.Minute, configured, false},
+		{"roamed without state", 3 * time.Minute, time.Minute, nil, false},
+		{"changed in config", 3 * time.Minute, time.Minute, previous, true},
+		{"stale handshake", 3 * time.Minute, 10 * time.Minute, configured, true},
+		{"no handshake", 3 * time.Minute, 0, configured, true},
+	} {
+		peer := wgtypes.Peer{PublicKey: peerKey, Endpoint: roamed}
+		if tc.handshake != 0 {
+			peer.LastHandshakeTime = time.Now().Add(-tc.handshake)
+		}
+		opts := Options{KeepRoamedEndpoints: tc.keep}
+		if tc.last != nil {
+			opts.LastEndpoints = map[wgtypes.Key]*net.UDPAddr{peerKey: tc.last}
+		}
+		diff, err := CalcDiff(
+			&wgtypes.Device{Peers: []wgtypes.Peer{peer}},
+			&wgtypes.Config{Peers: []wgtypes.PeerConfig{{PublicKey: peerKey, Endpoint: configured}}},
+			opts,
+		)
+		if err != nil {
+			t.Errorf("%s: CalcDiff failed: %v", tc.name, err)
+			continue
+		}
+		applied := len(diff.Peers) == 1 && endpointEqual(diff.Peers[0].Endpoint, configured)
+		if applied != tc.applied {
+			t.Errorf("%s: endpoint applied = %v, want %v", tc.name, applied, tc.applied)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package wgdiff
+
+import (
+	"fmt"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Redacted replaces the keys in a Plan, except the public keys.
+const Redacted = "(redacted)"
+
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old,omitempty"`
+	New   string `json:"new,omitempty"`
+}
+
+const (
+	PeerAdd    = "add"
+	PeerRemove = "remove"
+	PeerChange = "change"
+)
+
+type PeerPlan struct {
+	PublicKey string        `json:"public_key"`
+	Action    string        `json:"action"`
+	Fields    []FieldChange `json:"fields,omitempty"`
+}
+
+// Plan is a readable form of a diff, where the private key and the preshared
+// keys are redacted.
+type Plan struct {
+	Interface []FieldChange `json:"interface"`
+	Peers     []PeerPlan    `json:"peers"`
+}
+
+func (p *Plan) IsEmpty() bool {
+	return len(p.Interface) == 0 && len(p.Peers) == 0
+}
+
+// Describe tells what applying diff to current changes, current is nil if the
+// device does not exist yet.
+func Describe(current *wgtypes.Device, diff *wgtypes.Config) (plan Plan) {
+	plan.Interface = []FieldChange{}
+	plan.Peers = []PeerPlan{}
+	if current == nil {
+		current = &wgtypes.Device{}
+	}
+
+	if diff.PrivateKey != nil && *diff.PrivateKey != current.PrivateKey {
+		plan.Interface = append(plan.Interface, FieldChange{
+			Field: "private_key",
+			Old:   redactKey(current.PrivateKey),
+			New:   redactKey(*diff.PrivateKey),
+		}, FieldChange{
+			Field: "public_key",
+			Old:   publicKeyOf(current.PrivateKey),
+			New:   diff.PrivateKey.PublicKey().String(),
+		})
+	}
+	if diff.ListenPort != nil && *diff.ListenPort != current.ListenPort {
+		fc := FieldChange{
+			Field: "listen_port",
+			Old:   formatInt(current.ListenPort),
+			New:   formatInt(*diff.ListenPort),
+		}
+		if *diff.ListenPort == 0 {
+			fc.New = "(random)"
+		}
+		plan.Interface = append(plan.Interface, fc)
+	}
+	if diff.FirewallMark != nil && *diff.FirewallMark != current.FirewallMark {
+		plan.Interface = append(plan.Interface, FieldChange{
+			Field: "fwmark",
+			Old:   formatInt(current.FirewallMark),
+			New:   formatInt(*diff.FirewallMark),
+		})
+	}
+
+	oldPeers := make(map[wgtypes.Key]*wgtypes.Peer, len(current.Peers))
+	for i := range current.Peers {
+		oldPeers[current.Peers[i].PublicKey] = &current.Peers[i]
+	}
+	// removals are listed last, sorted, as they come from a map in CalcDiff
+	var removed []string
+	for i := range diff.Peers {
+		peer := &diff.Peers[i]
+		oldPeer, ok := oldPeers[peer.PublicKey]
+		if peer.Remove {
+			if ok {
+				removed = append(removed, peer.PublicKey.String())
+			}
+			continue
+		}
+		pp := PeerPlan{PublicKey: peer.PublicKey.String(), Action: PeerChange}
+		if !ok {
+			if peer.UpdateOnly {
+				continue
+			}
+			pp.Action = PeerAdd
+			oldPeer = &wgtypes.Peer{}
+		}
+
+		if peer.PresharedKey != nil && *peer.PresharedKey != oldPeer.PresharedKey {
+			pp.Fields = append(pp.Fields, FieldChange{
+				Field: "preshared_key",
+				Old:   redactKey(oldPeer.PresharedKey),
+				New:   redactKey(*peer.PresharedKey),
+			})
+		}
+		if peer.Endpoint != nil && (oldPeer.Endpoint == nil || !peer.Endpoint.IP.Equal(oldPeer.Endpoint.IP) || peer.Endpoint.Port != oldPeer.Endpoint.Port) {
+			fc := FieldChange{Field: "endpoint", New: peer.Endpoint.String()}
+			if oldPeer.Endpoint != nil {
+				fc.Old = oldPeer.Endpoint.String()
+			}
+			pp.Fields = append(pp.Fields, fc)
+		}
+		if peer.PersistentKeepaliveInterval != nil && *peer.PersistentKeepaliveInterval != oldPeer.PersistentKeepaliveInterval {
+			pp.Fields = append(pp.Fields, FieldChange{
+				Field: "persistent_keepalive",
+				Old:   formatKeepalive(oldPeer.PersistentKeepaliveInterval),
+				New:   formatKeepalive(*peer.PersistentKeepaliveInterval),
+			})
+		}
+
+		oldAllowedIPs := formatPrefixes(oldPeer.AllowedIPs)
+		var newAllowedIPs []string
+		if peer.ReplaceAllowedIPs {
+			newAllowedIPs = formatPrefixes(peer.AllowedIPs)
+		} else {
+			newAllowedIPs = formatPrefixes(append(append([]net.IPNet{}, oldPeer.AllowedIPs...), peer.AllowedIPs...))
+		}
+		if strings.Join(oldAllowedIPs, ", ") != strings.Join(newAllowedIPs, ", ") {
+			pp.Fields = append(pp.Fields, FieldChange{
+				Field: "allowed_ips",
+				Old:   strings.Join(oldAllowedIPs, ", "),
+				New:   strings.Join(newAllowedIPs, ", "),
+			})
+		}
+
+		if pp.Action == PeerAdd || len(pp.Fields) > 0 {
+			plan.Peers = append(plan.Peers, pp)
+		}
+	}
+	sort.Strings(removed)
+	for _, pubkey := range removed {
+		plan.Peers = append(plan.Peers, PeerPlan{PublicKey: pubkey, Action: PeerRemove})
+	}
+	return
+}
+
+func redactKey(key wgtypes.Key) string {
+	if key == (wgtypes.Key{}) {
+		return ""
+	}
+	return Redacted
+}
+
+func publicKeyOf(privateKey wgtypes.Key) string {
+	if privateKey == (wgtypes.Key{}) {
+		return ""
+	}
+	return privateKey.PublicKey().String()
+}
+
+func formatInt(i int) string {
+	if i == 0 {
+		return ""
+	}
+	return fmt.Sprint(i)
+}
+
+func formatKeepalive(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return fmt.Sprint(int(d.Seconds()))
+}
+
+// formatPrefixes returns the sorted and deduplicated prefixes
+func formatPrefixes(prefixes []net.IPNet) (ss []string) {
+	seen := map[string]bool{}
+	for _, prefix := range prefixes {
+		s := prefix.String()
+		if seen[s] {
+			continue
+		}
+		seen[s] = true
+		ss = append(ss, s)
+	}
+	sort.Strings(ss)
+	return
+}